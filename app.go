@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// updateTimeout bounds the time spent on a single update, retries of Telegram calls included
+const updateTimeout = time.Minute
+
+// Config is how the bot is set up, main reads it from the environment
+type Config struct {
+	Env string
+	// WebhookURL is where Telegram sends updates, it is only registered in production
+	WebhookURL    string
+	WebhookPath   string
+	WebhookSecret string
+	Workers       int
+	QueueSize     int
+}
+
+// App is the bot, with the store, Telegram client and update queue it works with
+type App struct {
+	config  Config
+	redis   *redis.Client
+	tg      *telegram
+	updates *dispatcher
+	log     *slog.Logger
+
+	// ready is false until startup is complete, and again once shutdown begins
+	ready atomic.Bool
+}
+
+func newApp(config Config, redisClient *redis.Client, tg *telegram, log *slog.Logger) *App {
+	a := &App{config: config, redis: redisClient, tg: tg, log: log}
+	a.updates = newDispatcher(config.Workers, config.QueueSize, a.handleUpdate, log)
+	return a
+}
@@ -0,0 +1,294 @@
+// Command cwmaze decodes Chat Wars dungeon maps and finds paths through them, the
+// same way the bot does, without Telegram or Redis.
+//
+// Usage:
+//
+//	cwmaze parse [--emoji] map.jpg
+//	cwmaze locate map.jpg scribble.txt
+//	cwmaze path map.jpg --from x,y [--to target] [--steps n] [--shortest]
+//	cwmaze render map.jpg --out path.png [--from x,y] [--to target] [--steps n] [--shortest]
+//
+// A target is boss, chest, mob, chest_n or mob_n for the nth nearest, or x,y.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	cwmaze "dungeonbot/maze"
+)
+
+const usage = `usage:
+  cwmaze parse [--emoji] map.jpg
+  cwmaze locate map.jpg scribble.txt
+  cwmaze path map.jpg --from x,y [--to target] [--steps n] [--shortest]
+  cwmaze render map.jpg --out path.png [--from x,y] [--to target] [--steps n] [--shortest]`
+
+var errUsage = errors.New(usage)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	verbose := fs.Bool("v", false, "log what the maze package is doing")
+
+	switch args[0] {
+	case "parse":
+		emoji := fs.Bool("emoji", false, "draw the grid with emoji instead of ASCII")
+		files, err := parseArgs(fs, args[1:], 1)
+		if err != nil {
+			return err
+		}
+		m, err := loadMaze(files[0], mazeLogger(*verbose, stderr))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s\nSize: %dx%d\nFingerprint: %s\n\n%s", m, m.Pixels.Width(), m.Pixels.Height(), m.Fingerprint(), m.Text(*emoji))
+
+	case "locate":
+		files, err := parseArgs(fs, args[1:], 2)
+		if err != nil {
+			return err
+		}
+		m, err := loadMaze(files[0], mazeLogger(*verbose, stderr))
+		if err != nil {
+			return err
+		}
+		scribble, err := os.ReadFile(files[1])
+		if err != nil {
+			return err
+		}
+		matches := m.SearchByScribble(scribbleText(string(scribble)))
+		if len(matches.Unknown) > 0 {
+			fmt.Fprintf(stderr, "unknown glyphs, matched as any tile: %s\n", strings.Join(matches.Unknown, " "))
+		}
+		fmt.Fprintf(stdout, "%d matches\n", len(matches.Matches))
+		for _, match := range matches.Matches {
+			fmt.Fprintf(stdout, "player at %s\n", cwmaze.Point{X: match.X + matches.PlayerLocation.X, Y: match.Y + matches.PlayerLocation.Y})
+		}
+
+	case "path", "render":
+		from := fs.String("from", "", "where the player is, as x,y")
+		to := fs.String("to", "boss", "where to go: boss, chest, mob, chest_n, mob_n or x,y")
+		steps := fs.Int("steps", cwmaze.DefaultSteps, "how many steps the player can take between fountains")
+		shortest := fs.Bool("shortest", false, "ignore fountains and take the shortest path")
+		out := fs.String("out", "", "where to write the rendered PNG")
+
+		files, err := parseArgs(fs, args[1:], 1)
+		if err != nil {
+			return err
+		}
+		if args[0] == "path" && *from == "" {
+			return fmt.Errorf("path needs --from\n%w", errUsage)
+		}
+		if args[0] == "render" && *out == "" {
+			return fmt.Errorf("render needs --out\n%w", errUsage)
+		}
+
+		m, err := loadMaze(files[0], mazeLogger(*verbose, stderr))
+		if err != nil {
+			return err
+		}
+
+		var player *cwmaze.Point
+		var path []cwmaze.Point
+		if *from != "" {
+			if player, err = parsePoint(*from); err != nil {
+				return err
+			}
+			if !m.Pixels.InBounds(*player) {
+				return fmt.Errorf("%s is outside the maze, which is %dx%d", player, m.Pixels.Width(), m.Pixels.Height())
+			}
+			if !m.Pixels.Walkable(*player) {
+				return fmt.Errorf("%s is a wall", player)
+			}
+			target, err := parseTarget(m, player, *to)
+			if err != nil {
+				return err
+			}
+
+			if *shortest {
+				path, err = m.ShortestPath(player, target)
+			} else {
+				path, err = m.FindPathWithSteps(player, target, *steps)
+			}
+			if errors.Is(err, cwmaze.ErrNoStepPath) {
+				fmt.Fprintln(stderr, err)
+			} else if err != nil {
+				return err
+			}
+
+			if args[0] == "path" {
+				fmt.Fprintf(stdout, "Path from %s to %s: %d steps\n", player, target, len(path)-1)
+				for _, p := range path {
+					fmt.Fprintln(stdout, p)
+				}
+			}
+		}
+
+		if *out != "" {
+			if err := writePNG(*out, render(m, player, path)); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown command %q\n%w", args[0], errUsage)
+	}
+	return nil
+}
+
+// parseArgs parses flags wherever they are among the arguments, and expects exactly n others
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if len(positional) != n {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d\n%w", fs.Name(), n, len(positional), errUsage)
+	}
+	return positional, nil
+}
+
+// mazeLogger logs what the maze package is doing to stderr with -v, or nothing
+func mazeLogger(verbose bool, stderr io.Writer) *slog.Logger {
+	if !verbose {
+		return nil
+	}
+	return slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+// loadMaze reads a map screenshot, the maze logs to log if it isn't nil
+func loadMaze(name string, log *slog.Logger) (*cwmaze.Maze, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s: %w", name, err)
+	}
+	m := &cwmaze.Maze{Log: log}
+	m.Load(img)
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("%s is not a map: %w", name, err)
+	}
+	return m, nil
+}
+
+// scribbleText takes the scribble out of a whole message, like the bot does, or
+// returns s if no grid is found in it
+func scribbleText(s string) string {
+	if scribble := cwmaze.FindScribble(s, 1); scribble != "" {
+		return scribble
+	}
+	return strings.TrimSpace(s)
+}
+
+func parsePoint(s string) (*cwmaze.Point, error) {
+	x, y, found := strings.Cut(s, ",")
+	if !found {
+		return nil, fmt.Errorf("invalid point %q, want x,y", s)
+	}
+	px, errX := strconv.Atoi(strings.TrimSpace(x))
+	py, errY := strconv.Atoi(strings.TrimSpace(y))
+	if errX != nil || errY != nil {
+		return nil, fmt.Errorf("invalid point %q, want x,y", s)
+	}
+	return &cwmaze.Point{X: px, Y: py}, nil
+}
+
+// parseTarget finds what the player wants to go to, like the bot's /path command
+func parseTarget(m *cwmaze.Maze, player *cwmaze.Point, s string) (*cwmaze.Point, error) {
+	if strings.Contains(s, ",") {
+		return parsePoint(s)
+	}
+
+	kind, number, _ := strings.Cut(s, "_")
+	n := 1
+	if number != "" {
+		var err error
+		if n, err = strconv.Atoi(number); err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid target %q", s)
+		}
+	}
+
+	var things []cwmaze.Point
+	switch kind {
+	case "boss":
+		return &m.Boss, nil
+	case "chest":
+		things = m.Chests
+	case "mob":
+		things = m.Mobs
+	default:
+		return nil, fmt.Errorf("invalid target %q, want boss, chest, mob, chest_n, mob_n or x,y", s)
+	}
+
+	nearest := m.Nearest(things, player, n)
+	if len(nearest) < n {
+		return nil, fmt.Errorf("there is no %s number %d", kind, n)
+	}
+	return &nearest[n-1], nil
+}
+
+// render draws the map with the player and path marked the way the bot does
+func render(m *cwmaze.Maze, player *cwmaze.Point, path []cwmaze.Point) *image.RGBA {
+	img := image.NewRGBA(m.Bounds())
+	draw.Draw(img, img.Bounds(), m, m.Bounds().Min, draw.Src)
+
+	mark := image.NewUniform(color.RGBA{255, 20, 255, 255})
+	for _, p := range path {
+		draw.Draw(img, image.Rect(p.X*5+2, p.Y*5+2, p.X*5+5, p.Y*5+4), mark, image.Point{}, draw.Src)
+	}
+	if player != nil {
+		draw.Draw(img, image.Rect(player.X*5, player.Y*5, player.X*5+5, player.Y*5+5), mark, image.Point{}, draw.Src)
+	}
+	return img
+}
+
+func writePNG(name string, img image.Image) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
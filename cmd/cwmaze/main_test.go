@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cwmaze "dungeonbot/maze"
+)
+
+const testMap = "../../maze/test.jpeg"
+
+func TestParse(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"parse", testMap}, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stdout.String(), "This map has 48 chests") || !strings.Contains(stdout.String(), "Size: 161x161") {
+		t.Errorf("parse printed %.200q", stdout.String())
+	}
+}
+
+func TestRender(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "path.png")
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"render", testMap, "--out", out, "--from", "1,1", "--to", "mob", "--shortest"}, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(out); err != nil || info.Size() == 0 {
+		t.Errorf("render wrote nothing to %s: %v", out, err)
+	}
+}
+
+func TestPathFromInvalidPlace(t *testing.T) {
+	for _, from := range []string{"0,0", "161,1", "1,-1"} {
+		var stdout, stderr bytes.Buffer
+		if err := run([]string{"path", testMap, "--from", from}, &stdout, &stderr); err == nil {
+			t.Errorf("path --from %s succeeded and printed %.100q", from, stdout.String())
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	cases := [][]string{
+		{},
+		{"fly", testMap},
+		{"parse"},
+		{"path", testMap},
+		{"render", testMap},
+	}
+	for _, args := range cases {
+		var stdout, stderr bytes.Buffer
+		if err := run(args, &stdout, &stderr); !errors.Is(err, errUsage) {
+			t.Errorf("run(%q) = %v, want the usage", args, err)
+		}
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	m := &cwmaze.Maze{
+		Boss:   cwmaze.Point{X: 9, Y: 9},
+		Chests: []cwmaze.Point{{X: 5, Y: 5}, {X: 1, Y: 2}},
+		Mobs:   []cwmaze.Point{{X: 3, Y: 3}},
+	}
+	player := &cwmaze.Point{X: 1, Y: 1}
+
+	cases := map[string]cwmaze.Point{
+		"boss":    {X: 9, Y: 9},
+		"chest":   {X: 1, Y: 2},
+		"chest_2": {X: 5, Y: 5},
+		"mob":     {X: 3, Y: 3},
+		"4, 7":    {X: 4, Y: 7},
+	}
+	for s, want := range cases {
+		got, err := parseTarget(m, player, s)
+		if err != nil || *got != want {
+			t.Errorf("parseTarget(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+
+	for _, s := range []string{"mob_2", "chest_0", "fountain", "1;2"} {
+		if got, err := parseTarget(m, player, s); err == nil {
+			t.Errorf("parseTarget(%q) = %v, want an error", s, got)
+		}
+	}
+}
+
+func TestScribbleText(t *testing.T) {
+	message := "You stopped and tried to mark your way on paper.\n\n⬛⬜⬛\n⬜🟨⬜\n\nSome other text"
+	if got := scribbleText(message); got != "⬛⬜⬛\n⬜🟨⬜" {
+		t.Errorf("scribbleText(message) = %q", got)
+	}
+	if got := scribbleText("⬛⬜⬛\n⬜🟨⬜\n"); got != "⬛⬜⬛\n⬜🟨⬜" {
+		t.Errorf("scribbleText(scribble) = %q", got)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// Telegram gives up redelivering an update after 24 hours
+	updateTTL = 24 * time.Hour
+	// claimTTL is how long a queued update stays claimed before it is handled,
+	// so updates lost to a crash or a slow shutdown are handled when redelivered
+	claimTTL = 10 * time.Minute
+)
+
+func updateKey(updateID int64) string {
+	return fmt.Sprintf("Update-%d", updateID)
+}
+
+// claimUpdate records that an update is being handled. It returns false if
+// the update was seen before, meaning this is a redelivery to skip.
+func (a *App) claimUpdate(ctx context.Context, updateID int64) (bool, error) {
+	if updateID == 0 {
+		// nothing to deduplicate on
+		return true, nil
+	}
+	return a.redis.SetNX(ctx, updateKey(updateID), 1, claimTTL).Result()
+}
+
+// completeUpdate keeps a handled update's claim for as long as Telegram may redeliver it
+func (a *App) completeUpdate(ctx context.Context, updateID int64, log *slog.Logger) {
+	if updateID == 0 {
+		return
+	}
+	if err := a.redis.Expire(ctx, updateKey(updateID), updateTTL).Err(); err != nil {
+		log.Error("could not record handled update", "error", err)
+	}
+}
+
+// releaseUpdate forgets a claimed update, so a redelivery will be handled
+func (a *App) releaseUpdate(ctx context.Context, updateID int64, log *slog.Logger) {
+	if updateID == 0 {
+		return
+	}
+	if err := a.redis.Del(ctx, updateKey(updateID)).Err(); err != nil {
+		log.Error("could not release update", "error", err)
+	}
+}
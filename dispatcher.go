@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+)
+
+var (
+	errQueueFull = errors.New("update queue is full")
+	errClosed    = errors.New("dispatcher is closed")
+)
+
+// job is a queued update, with the context to handle it in
+type job struct {
+	ctx context.Context
+	u   *update
+}
+
+// dispatcher runs updates on a fixed pool of workers. Updates for the same chat
+// always go to the same worker, so they are handled in the order they arrived.
+type dispatcher struct {
+	queues []chan job
+	handle func(context.Context, *update)
+	log    *slog.Logger
+
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+func newDispatcher(workers, queueSize int, handle func(context.Context, *update), log *slog.Logger) *dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	d := &dispatcher{
+		queues: make([]chan job, workers),
+		handle: handle,
+		log:    log,
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan job, queueSize)
+		d.workers.Add(1)
+		go d.work(d.queues[i])
+	}
+	return d
+}
+
+// Enqueue queues u to be handled in ctx without blocking, it fails if the chat's
+// worker is too far behind
+func (d *dispatcher) Enqueue(ctx context.Context, u *update) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return errClosed
+	}
+
+	chatID := u.chatID()
+	if chatID < 0 {
+		// group chats have negative IDs
+		chatID = -chatID
+	}
+
+	select {
+	case d.queues[chatID%int64(len(d.queues))] <- job{ctx, u}:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// Close stops accepting updates and waits for the queued ones to be handled
+func (d *dispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, queue := range d.queues {
+			close(queue)
+		}
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *dispatcher) work(queue chan job) {
+	defer d.workers.Done()
+	for j := range queue {
+		d.run(j)
+	}
+}
+
+// run handles a single update, a panic only loses that update rather than the worker
+func (d *dispatcher) run(j job) {
+	defer func() {
+		if err := recover(); err != nil {
+			updateLogger(d.log, j.u).Error("panic handling update", "panic", err, "stack", string(debug.Stack()))
+		}
+	}()
+	d.handle(j.ctx, j.u)
+}
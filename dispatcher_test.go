@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/lawn-chair/gobot/tgbot"
+)
+
+var ctx = context.Background()
+
+func chatUpdate(chatID int64, text string) *update {
+	u := &update{}
+	u.Message.Chat.ID = chatID
+	u.Message.Text = text
+	return u
+}
+
+func TestDispatcherKeepsChatOrder(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[int64][]string)
+
+	d := newDispatcher(3, 100, func(ctx context.Context, u *update) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[u.chatID()] = append(seen[u.chatID()], u.Message.Text)
+	}, slog.Default())
+
+	want := []string{"a", "b", "c", "d", "e"}
+	for _, text := range want {
+		for chatID := int64(-2); chatID <= 5; chatID++ {
+			if err := d.Enqueue(ctx, chatUpdate(chatID, text)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for chatID := int64(-2); chatID <= 5; chatID++ {
+		if got := seen[chatID]; len(got) != len(want) {
+			t.Errorf("chat %d handled %v, want %v", chatID, got, want)
+		} else {
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("chat %d handled %v, want %v", chatID, got, want)
+					break
+				}
+			}
+		}
+	}
+
+	if err := d.Enqueue(ctx, chatUpdate(1, "late")); err != errClosed {
+		t.Errorf("Enqueue after Close = %v, want %v", err, errClosed)
+	}
+}
+
+func TestDispatcherQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	d := newDispatcher(1, 1, func(ctx context.Context, u *update) { <-block }, slog.Default())
+
+	// the first update is picked up by the worker, the second fills the queue
+	d.Enqueue(ctx, chatUpdate(1, "a"))
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = d.Enqueue(ctx, chatUpdate(1, "b"))
+	}
+	if err != errQueueFull {
+		t.Errorf("Enqueue on a full queue = %v, want %v", err, errQueueFull)
+	}
+
+	close(block)
+	d.Close(context.Background())
+}
+
+func TestDispatcherRecoversPanics(t *testing.T) {
+	handled := 0
+	d := newDispatcher(1, 10, func(ctx context.Context, u *update) {
+		handled++
+		if u.Message.Text == "boom" {
+			panic("boom")
+		}
+	}, slog.Default())
+
+	d.Enqueue(ctx, chatUpdate(1, "boom"))
+	d.Enqueue(ctx, chatUpdate(1, "ok"))
+	d.Close(context.Background())
+
+	if handled != 2 {
+		t.Errorf("handled %d updates, want 2", handled)
+	}
+}
+
+func TestUpdateChatID(t *testing.T) {
+	u := &update{CallbackQuery: &callbackQuery{Message: &callbackMessage{Chat: tgbot.Chat{ID: 42}}}}
+	if u.chatID() != 42 {
+		t.Errorf("chatID() = %d, want 42", u.chatID())
+	}
+}
@@ -9,197 +9,338 @@ import (
 	"image/color"
 	"image/draw"
 	_ "image/jpeg"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	cwmaze "dungeonbot/maze"
+	"dungeonbot/mdv2"
 
 	"github.com/lawn-chair/gobot/tgbot"
 
 	"github.com/fogleman/gg"
 	"github.com/golang/freetype/truetype"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
+	xdraw "golang.org/x/image/draw"
 	"golang.org/x/image/font/gofont/goregular"
 )
 
 // This handler is called everytime telegram sends us a webhook event
-func Handler(res http.ResponseWriter, req *http.Request) {
+func (a *App) Handler(res http.ResponseWriter, req *http.Request) {
 	// First, decode the JSON response body
-	body := &tgbot.Update{}
+	body := &update{}
 
+	req.Body = http.MaxBytesReader(res, req.Body, maxUpdateSize)
 	if err := json.NewDecoder(req.Body).Decode(body); err != nil {
-		fmt.Println("could not decode request body", err)
+		a.log.Warn("could not decode update", "error", err)
+		http.Error(res, "invalid update", http.StatusBadRequest)
 		return
 	}
 
-	if body.Message.Photo != nil {
-		fullSizeImage := tgbot.GetFullSizeImage(body.Message.Photo)
-		res, err := bot.SendCommand("getFile", struct {
-			FileID string `json:"file_id"`
-		}{fullSizeImage})
-		if err != nil {
-			bot.Respond(body.Message, "Failed to get map image from Telegram server")
-			fmt.Println(err)
-			return
-		}
+	updatesTotal.WithLabelValues("received").Inc()
+	log := updateLogger(a.log, body)
 
-		fileInfo := &tgbot.Response[tgbot.File]{}
+	claimed, err := a.claimUpdate(req.Context(), body.UpdateID)
+	if err != nil {
+		// better to risk handling an update twice than to drop it
+		log.Error("could not check for duplicate update", "error", err)
+	} else if !claimed {
+		updatesTotal.WithLabelValues("duplicate").Inc()
+		log.Info("skipping duplicate update")
+		return
+	}
 
-		if err := json.NewDecoder(res.Body).Decode(fileInfo); err != nil {
-			bot.Respond(body.Message, "Failed to get map image from Telegram server")
-			fmt.Println("could not decode getFile response", err)
-			return
+	// Telegram only needs to know we have the update, replies are sent by a worker.
+	// Handling outlives the request, so it keeps the request's values but not its cancellation.
+	if err := a.updates.Enqueue(context.WithoutCancel(req.Context()), body); err != nil {
+		updatesTotal.WithLabelValues("rejected").Inc()
+		log.Warn("could not queue update", "error", err)
+		if claimed {
+			a.releaseUpdate(req.Context(), body.UpdateID, log)
 		}
+		http.Error(res, "busy", http.StatusServiceUnavailable)
+		return
+	}
+	updatesTotal.WithLabelValues("queued").Inc()
+}
 
-		fileRes, err := bot.DownloadFile(fileInfo.Result.FilePath)
-		if err != nil {
-			bot.Respond(body.Message, "Failed to get map image from Telegram server")
-			fmt.Println(err)
-			return
-		}
+// handleUpdate does the work for a single update, called from the dispatcher's workers
+func (a *App) handleUpdate(ctx context.Context, body *update) {
+	log := updateLogger(a.log, body)
+	// runs last, once the update is handled or its panic recovered
+	defer a.completeUpdate(ctx, body.UpdateID, log)
+	ctx, cancel := context.WithTimeout(ctx, updateTimeout)
+	defer cancel()
 
-		m := cwmaze.Maze{}
-		mazeImage, _, err := image.Decode(fileRes.Body)
-		if err != nil {
-			bot.Respond(body.Message, "Failed to decode map image")
-			fmt.Println(err)
-			return
+	ctx = withLogger(ctx, log)
+	defer a.recoverUpdate(ctx, body, log)
+
+	// edits are only worth answering when they correct a scribble
+	if body.Edited && scribbleIn(body.Message.Text) == "" {
+		log.Debug("ignoring edited message without a scribble")
+		return
+	}
+	a.touchSession(ctx, body.chatID(), log)
+
+	if body.CallbackQuery != nil {
+		commandsTotal.WithLabelValues("callback").Inc()
+		a.handleSettingsCallback(ctx, body.CallbackQuery, log)
+		return
+	}
+
+	settings := a.getSettings(ctx, body.Message.Chat.ID, log)
+	tr := newTranslator(settings, body.From, log)
+	r := &responder{app: a, message: body.Message, settings: settings, tr: tr, log: log}
+	defer r.flush(ctx)
+
+	if len(body.Photo) > 0 {
+		commandsTotal.WithLabelValues("map").Inc()
+		fullSize := largestPhoto(body.Photo)
+
+		// a photo Telegram has seen before is a map we decoded before
+		var m *cwmaze.Maze
+		var fingerprint string
+		if fullSize.FileUniqueID != "" {
+			var err error
+			fingerprint, err = a.redis.Get(ctx, photoKey(fullSize.FileUniqueID)).Result()
+			if err == nil {
+				m, err = a.loadMap(ctx, fingerprint)
+			}
+			if err == nil {
+				outcomesTotal.WithLabelValues("map", "cached").Inc()
+				log.Debug("map photo seen before, skipping decode", "file_unique_id", fullSize.FileUniqueID, "map", fingerprint)
+			} else if err != redis.Nil {
+				log.Error("could not fetch cached map", "error", err)
+			}
 		}
 
-		m.Load(mazeImage)
+		if m == nil {
+			fileInfo, err := a.tg.GetFile(ctx, fullSize.FileID)
+			if err != nil {
+				outcomesTotal.WithLabelValues("map", "download_failed").Inc()
+				r.reply(tr.T("map.download_failed"))
+				log.Error("could not get map file info", "error", err)
+				return
+			}
 
-		bot.RespondPhoto(body.Message, m)
+			fileBody, err := a.tg.Download(ctx, fileInfo.FilePath)
+			if err != nil {
+				outcomesTotal.WithLabelValues("map", "download_failed").Inc()
+				r.reply(tr.T("map.download_failed"))
+				log.Error("could not download map", "error", err)
+				return
+			}
+			defer fileBody.Close()
 
-		fmt.Println("m.String(): ", m.String(), m)
-		bot.Respond(body.Message, tgbot.EscapeString(m.String()))
+			decodeStart := time.Now()
+			mazeImage, _, err := image.Decode(fileBody)
+			if err != nil {
+				outcomesTotal.WithLabelValues("map", "decode_failed").Inc()
+				r.reply(tr.T("map.decode_failed"))
+				log.Warn("could not decode map image", "error", err)
+				return
+			}
 
-		mazeJson, err := json.Marshal(m)
-		if err != nil {
-			fmt.Println(err)
+			m = &cwmaze.Maze{Log: log}
+			m.Load(mazeImage)
+			if err := m.Validate(); err != nil {
+				outcomesTotal.WithLabelValues("map", "decode_failed").Inc()
+				r.reply(tr.T("map.decode_failed"))
+				log.Warn("map image is not a valid map", "error", err)
+				return
+			}
+			fingerprint = m.Fingerprint()
+			since(decodeStart, mapDecodeSeconds)
+			outcomesTotal.WithLabelValues("map", "decoded").Inc()
+
+			log.Debug("loaded map", "map", fingerprint, "summary", m.String(), "width", m.Pixels.Width(), "height", m.Pixels.Height())
+			if err := a.saveMap(ctx, m, fingerprint); err != nil {
+				log.Error("could not save map", "error", err)
+				r.reply(tr.T("map.save_failed"))
+				return
+			}
+			if fullSize.FileUniqueID != "" {
+				if err := a.redis.Set(ctx, photoKey(fullSize.FileUniqueID), fingerprint, photoTTL).Err(); err != nil {
+					log.Error("could not cache map photo", "error", err)
+				}
+			}
 		}
 
-		err = redisClient.Set(ctx, fmt.Sprint(body.Message.Chat.ID), mazeJson, 0).Err()
-		if err != nil {
-			fmt.Println(err)
-			bot.Respond(body.Message, "Failed to save map")
+		r.image(m)
+		r.info(tr.MapSummary(*m))
+
+		_, current, err := a.getChatMap(ctx, body.Message.Chat.ID)
+		if err != nil && err != redis.Nil {
+			log.Error("could not fetch current map", "error", err)
+		}
+		if current == fingerprint {
+			// the same map forwarded again, carry on from where the player was
+			r.info(tr.T("map.unchanged"))
+			return
+		}
+
+		if err := a.setChatMap(ctx, body.Message.Chat.ID, fingerprint); err != nil {
+			log.Error("could not save map", "error", err)
+			r.reply(tr.T("map.save_failed"))
 		}
 
-		err = redisClient.Del(ctx, fmt.Sprintf("%d-Scribble", body.Message.Chat.ID)).Err()
+		err = a.redis.Del(ctx, fmt.Sprintf("%d-Scribble", body.Message.Chat.ID)).Err()
 		if err != nil {
-			fmt.Println(err)
+			log.Error("could not delete scribble", "error", err)
 		}
 
-		err = redisClient.Del(ctx, fmt.Sprintf("%d-Location", body.Message.Chat.ID)).Err()
+		err = a.redis.Del(ctx, fmt.Sprintf("%d-Location", body.Message.Chat.ID)).Err()
 		if err != nil {
-			fmt.Println(err)
+			log.Error("could not delete location", "error", err)
 		}
 
-	} else if strings.Contains(body.Message.Text, "You stopped and tried to mark your way on paper.") {
+		if err := a.forgetMapView(ctx, body.Message.Chat.ID); err != nil {
+			log.Error("could not delete map view", "error", err)
+		}
 
-		sections := strings.Split(body.Message.Text, "\n\n")
+	} else if scribble := scribbleIn(body.Message.Text); scribble != "" {
+		// a scribble is found wherever it is in the message, forwarded from the game
+		// in any language, pasted on its own or after /locate
+		commandsTotal.WithLabelValues("scribble").Inc()
 
-		maze := &cwmaze.Maze{}
-		mazeJson, err := redisClient.Get(ctx, fmt.Sprint(body.Message.Chat.ID)).Result()
+		maze, _, err := a.getChatMap(ctx, body.Message.Chat.ID)
 		if err != nil {
 			if err == redis.Nil {
-				bot.Respond(body.Message, "No map found, please forward map before sending a scribble")
+				r.reply(tr.T("map.missing"))
 			} else {
-				bot.Respond(body.Message, "Error fetching map")
-				fmt.Println("error fetching map from redis", err)
+				r.reply(tr.T("map.fetch_failed"))
+				log.Error("could not fetch map", "error", err)
 			}
 			return
 		}
 
-		if err := json.NewDecoder(strings.NewReader(mazeJson)).Decode(maze); err != nil {
-			fmt.Println("could not decode request body", err)
-			return
+		searchStart := time.Now()
+		matches := maze.SearchByScribble(scribble)
+		since(searchStart, scribbleSearchSeconds)
+
+		switch len(matches.Matches) {
+		case 0:
+			outcomesTotal.WithLabelValues("scribble", "none").Inc()
+		case 1:
+			outcomesTotal.WithLabelValues("scribble", "matched").Inc()
+		default:
+			outcomesTotal.WithLabelValues("scribble", "ambiguous").Inc()
 		}
 
-		if len(sections) > 1 {
-			matches := maze.SearchByScribble(sections[1])
+		log.Debug("searched by scribble", "matches", len(matches.Matches), "player", matches.PlayerLocation)
 
-			fmt.Println(matches)
+		if len(matches.Unknown) > 0 {
+			r.reply(tr.T("scribble.unknown", strings.Join(matches.Unknown, " ")))
+		}
+		if len(matches.Matches) == 0 {
+			// the stored scribble keeps these, with no matches, so later commands know it failed
+			matches.Closest = maze.NearMatches(matches, closestMatches)
+			log.Info("scribble matches nowhere", "closest", matches.Closest)
+		} else {
+			r.reply(tr.T("scribble.matches", len(matches.Matches), fmt.Sprint(matches.Matches)))
+		}
 
-			bot.Respond(body.Message, matches.String())
+		/* This will send a picture of the scribble
+		buf := new(bytes.Buffer)
+		png.Encode(buf, matches)
 
-			/* This will send a picture of the scribble
-			buf := new(bytes.Buffer)
-			png.Encode(buf, matches)
+		sendPic := []SendFile{
+			{
+				"photo",
+				"scribble.png",
+				buf,
+			},
+		}
+		bot.SendFiles("sendPhoto", struct {
+			ChatID int64 `json:"chat_id"`
+		}{body.Message.Chat.ID}, sendPic)
+		*/
 
-			sendPic := []SendFile{
-				{
-					"photo",
-					"scribble.png",
-					buf,
-				},
-			}
-			bot.SendFiles("sendPhoto", struct {
-				ChatID int64 `json:"chat_id"`
-			}{body.Message.Chat.ID}, sendPic)
-			*/
-
-			// create the composite image with the map and scribbles highlighted
-			composite := image.NewRGBA(image.Rect(0, 0, maze.Bounds().Dx(), maze.Bounds().Dy()))
-			draw.Draw(composite, composite.Bounds(), maze, maze.Bounds().Bounds().Min, draw.Src)
-
-			gc := gg.NewContextForRGBA(composite)
-			for _, match := range matches.Matches {
-				playerX := (float64)(match.X+matches.PlayerLocation.X) * 5
-				playerY := (float64)(match.Y+matches.PlayerLocation.Y) * 5
-				gc.DrawCircle(playerX, playerY, 20)
-				gc.SetRGBA(100, 255, 100, 150)
-				gc.SetColor(color.NRGBA{100, 255, 100, 150})
-				gc.Fill()
-
-				drawPlayerBox(composite, &cwmaze.Point{X: match.X + matches.PlayerLocation.X, Y: match.Y + matches.PlayerLocation.Y})
-			}
+		// create the composite image with the map and scribbles highlighted
+		composite := image.NewRGBA(image.Rect(0, 0, maze.Bounds().Dx(), maze.Bounds().Dy()))
+		draw.Draw(composite, composite.Bounds(), maze, maze.Bounds().Bounds().Min, draw.Src)
 
-			bot.RespondPhoto(body.Message, composite)
+		gc := gg.NewContextForRGBA(composite)
+		for _, match := range matches.Matches {
+			playerX := (float64)(match.X+matches.PlayerLocation.X) * 5
+			playerY := (float64)(match.Y+matches.PlayerLocation.Y) * 5
+			gc.DrawCircle(playerX, playerY, 20)
+			gc.SetRGBA(100, 255, 100, 150)
+			gc.SetColor(color.NRGBA{100, 255, 100, 150})
+			gc.Fill()
 
-			if len(matches.Matches) == 1 {
-				_, err := bot.Respond(body.Message, "*Location Found\\!* Try these commands for more help:\n\n\\/path to find a path to the boss using fountains\n\\/path\\_chest for a path to the nearest chest\n\\/path\\_mob for a path to the nearest mob\n\nFor more options try \\/mobs or \\/chests")
-				if err != nil {
-					fmt.Println(err)
-				}
-				bot.Respond(body.Message, fmt.Sprintf("Player at: \\{%d, %d\\}", matches.Matches[0].X+matches.PlayerLocation.X, matches.Matches[0].Y+matches.PlayerLocation.Y))
-			} else {
-				bot.Respond(body.Message, fmt.Sprintf("Found %d locations matching scribble", len(matches.Matches)))
-			}
+			drawPlayerBox(composite, &cwmaze.Point{X: match.X + matches.PlayerLocation.X, Y: match.Y + matches.PlayerLocation.Y})
+		}
+		for _, near := range matches.Closest {
+			player := cwmaze.Point{X: near.At.X + matches.PlayerLocation.X, Y: near.At.Y + matches.PlayerLocation.Y}
+			gc.DrawCircle(float64(player.X)*5, float64(player.Y)*5, 20)
+			gc.SetColor(color.NRGBA{255, 165, 0, 150})
+			gc.Fill()
 
-			matchJson, err := json.Marshal(matches)
-			if err != nil {
-				fmt.Println(err)
-			}
+			drawPlayerBox(composite, &player)
+		}
 
-			err = redisClient.Set(ctx, fmt.Sprintf("%d-Scribble", body.Message.Chat.ID), matchJson, 0).Err()
-			if err != nil {
-				fmt.Println(err)
-				bot.Respond(body.Message, "Failed to save scribble")
-			}
+		r.mapImage(composite)
 
-			err = redisClient.Del(ctx, fmt.Sprintf("%d-Location", body.Message.Chat.ID)).Err()
-			if err != nil {
-				fmt.Println(err)
+		switch len(matches.Matches) {
+		case 0:
+			var closest []string
+			for _, near := range matches.Closest {
+				player := cwmaze.Point{X: near.At.X + matches.PlayerLocation.X, Y: near.At.Y + matches.PlayerLocation.Y}
+				closest = append(closest, tr.Plain("scribble.near", player, near.Mismatches))
+			}
+			r.reply(tr.Bold("scribble.not_found"))
+			if len(closest) > 0 {
+				r.reply(tr.T("scribble.closest", strings.Join(closest, ", ")))
 			}
+			r.reply(tr.T("scribble.stale_map"))
+			// show how the scribble was read, in case a tile was misread
+			r.image(renderScribble(matches))
+		case 1:
+			r.reply(tr.Bold("scribble.found") + " " + tr.T("scribble.help"))
+			r.reply(tr.Markdown("scribble.player_at", mdv2.Coordinate(matches.Matches[0].X+matches.PlayerLocation.X, matches.Matches[0].Y+matches.PlayerLocation.Y)))
+		default:
+			r.reply(tr.T("scribble.found_many", len(matches.Matches)))
+		}
 
-		} else {
-			bot.Respond(body.Message, "There seems to be a problem with your scribble")
+		matchJson, err := json.Marshal(matches)
+		if err != nil {
+			log.Error("could not encode scribble", "error", err)
 		}
 
+		err = a.redis.Set(ctx, fmt.Sprintf("%d-Scribble", body.Message.Chat.ID), matchJson, 0).Err()
+		if err != nil {
+			log.Error("could not save scribble", "error", err)
+			r.reply(tr.T("scribble.save_failed"))
+		}
+
+		err = a.redis.Del(ctx, fmt.Sprintf("%d-Location", body.Message.Chat.ID)).Err()
+		if err != nil {
+			log.Error("could not delete location", "error", err)
+		}
+
+	} else if strings.HasPrefix(body.Message.Text, "/locate") || strings.Contains(body.Message.Text, scribbleMarker) {
+		commandsTotal.WithLabelValues("scribble").Inc()
+		outcomesTotal.WithLabelValues("scribble", "invalid").Inc()
+		r.reply(tr.T("scribble.invalid"))
+		r.reply(tr.T("scribble.locate"))
+
 	} else if strings.HasPrefix(body.Message.Text, "/path") {
-		maze, scribble, location, err := getPlayerState(body.Message)
+		commandsTotal.WithLabelValues("path").Inc()
+		maze, scribble, location, err := a.getPlayerState(ctx, body.Message)
 
 		if err != nil {
-			bot.Respond(body.Message, fmt.Sprint(err))
+			r.reply(tr.Error(err))
 			return
 		}
 
 		if len(scribble.Matches) > 1 {
-			bot.Respond(body.Message, fmt.Sprintf("Scribble matches %d locations in map.  Must be 1 to find path", len(scribble.Matches)))
+			r.reply(tr.T("scribble.ambiguous", len(scribble.Matches), tr.Plain("action.path")))
 			return
 		}
 
@@ -213,38 +354,41 @@ func Handler(res http.ResponseWriter, req *http.Request) {
 		}
 
 		if matches == nil {
-			bot.Respond(body.Message, "Could not parse command")
+			r.reply(tr.T("command.unparsed"))
 			return
 		}
 
-		switch matches[0][2] {
-		case "chest":
-			if matches[0][4] != "" {
-				num, _ := strconv.Atoi(matches[0][4])
-				if num > len(maze.Chests) {
-					bot.Respond(body.Message, fmt.Sprintf("Invalid chest number: %d", num))
-					return
-				}
-				thingToFind = cwmaze.Nearest(maze.Chests, location, num)[num-1]
-			} else {
-				thingToFind = cwmaze.Nearest(maze.Chests, location, 1)[0]
+		if kind := matches[0][2]; kind == "chest" || kind == "mob" {
+			things := maze.Chests
+			if kind == "mob" {
+				things = maze.Mobs
 			}
-		case "mob":
+			num := 1
 			if matches[0][4] != "" {
-				num, _ := strconv.Atoi(matches[0][4])
-				if num > len(maze.Mobs) {
-					bot.Respond(body.Message, fmt.Sprintf("Invalid mob number: %d", num))
-					return
-				}
-				thingToFind = cwmaze.Nearest(maze.Mobs, location, num)[num-1]
-			} else {
-				thingToFind = cwmaze.Nearest(maze.Mobs, location, 1)[0]
+				num, _ = strconv.Atoi(matches[0][4])
+			}
+			// Nearest skips the thing the player stands on, so it can return fewer than asked for
+			nearest := maze.Nearest(things, location, num)
+			if num < 1 || len(nearest) < num {
+				r.reply(tr.T("path.invalid_"+kind, num))
+				return
 			}
+			thingToFind = nearest[num-1]
 		}
 
-		path, err := maze.FindPath(location, &thingToFind)
+		pathStart := time.Now()
+		path, err := findPath(maze, settings, location, &thingToFind)
+		since(pathStart, findPathSeconds.WithLabelValues(settings.Routing))
+		switch {
+		case err == nil:
+			outcomesTotal.WithLabelValues("path", "found").Inc()
+		case errors.Is(err, cwmaze.ErrNoStepPath):
+			outcomesTotal.WithLabelValues("path", "fallback").Inc()
+		default:
+			outcomesTotal.WithLabelValues("path", "none").Inc()
+		}
 		if err != nil {
-			bot.Respond(body.Message, fmt.Sprint(err))
+			r.reply(tr.Error(err))
 		}
 
 		// create the composite image with the map and scribbles highlighted
@@ -262,28 +406,33 @@ func Handler(res http.ResponseWriter, req *http.Request) {
 			gc.Stroke()
 		}
 
-		bot.RespondPhoto(body.Message, composite)
+		r.mapImage(composite)
+		if len(path) > 0 {
+			r.info(tr.T("path.summary", thingToFind, tr.Count("count.steps", len(path)-1)))
+		}
 	} else if strings.HasPrefix(body.Message.Text, "/mobs") {
-		maze, scribble, player, err := getPlayerState(body.Message)
+		commandsTotal.WithLabelValues("mobs").Inc()
+		maze, scribble, player, err := a.getPlayerState(ctx, body.Message)
 
 		if err != nil {
-			bot.Respond(body.Message, fmt.Sprint(err))
+			r.reply(tr.Error(err))
 			return
 		}
 
 		if len(scribble.Matches) > 1 {
-			bot.Respond(body.Message, fmt.Sprintf("Scribble matches %d locations in map.  Must be 1 to find mobs", len(scribble.Matches)))
+			r.reply(tr.T("scribble.ambiguous", len(scribble.Matches), tr.Plain("action.mobs")))
 			return
 		}
 
 		if player == nil {
 			player = &cwmaze.Point{X: scribble.Matches[0].X + scribble.PlayerLocation.X, Y: scribble.Matches[0].Y + scribble.PlayerLocation.Y}
 		}
-		list := cwmaze.Nearest(maze.Mobs, player, 5)
+		list := maze.Nearest(maze.Mobs, player, settings.ListLength)
 
 		font, err := truetype.Parse(goregular.TTF)
 		if err != nil {
-			log.Fatal(err)
+			log.Error("could not parse font", "error", err)
+			return
 		}
 
 		face := truetype.NewFace(font, &truetype.Options{Size: 16})
@@ -303,32 +452,34 @@ func Handler(res http.ResponseWriter, req *http.Request) {
 			gc.SetColor(color.NRGBA{255, 255, 255, 255})
 			gc.DrawString(fmt.Sprintf("%d", c+1), (float64)(list[c].X*5-2), (float64)(list[c].Y*5+8))
 		}
-		bot.RespondPhoto(body.Message, composite)
+		r.mapImage(composite)
 
 		for c := range list {
-			bot.Respond(body.Message, fmt.Sprintf("\\/path\\_mob\\_%d path to mob at \\{%d, %d\\} \\/at\\_%d\\_%d", c+1, list[c].X, list[c].Y, list[c].X, list[c].Y))
+			r.info(tr.Markdown("list.mob", mdv2.Command("path", "mob", c+1), mdv2.Coordinate(list[c].X, list[c].Y), mdv2.Command("at", list[c].X, list[c].Y)))
 		}
 	} else if strings.HasPrefix(body.Message.Text, "/chests") {
-		maze, scribble, player, err := getPlayerState(body.Message)
+		commandsTotal.WithLabelValues("chests").Inc()
+		maze, scribble, player, err := a.getPlayerState(ctx, body.Message)
 
 		if err != nil {
-			bot.Respond(body.Message, fmt.Sprint(err))
+			r.reply(tr.Error(err))
 			return
 		}
 
 		if len(scribble.Matches) > 1 {
-			bot.Respond(body.Message, fmt.Sprintf("Scribble matches %d locations in map.  Must be 1 to find chests", len(scribble.Matches)))
+			r.reply(tr.T("scribble.ambiguous", len(scribble.Matches), tr.Plain("action.chests")))
 			return
 		}
 
 		if player == nil {
 			player = &cwmaze.Point{X: scribble.Matches[0].X + scribble.PlayerLocation.X, Y: scribble.Matches[0].Y + scribble.PlayerLocation.Y}
 		}
-		list := cwmaze.Nearest(maze.Chests, player, 5)
+		list := maze.Nearest(maze.Chests, player, settings.ListLength)
 
 		font, err := truetype.Parse(goregular.TTF)
 		if err != nil {
-			log.Fatal(err)
+			log.Error("could not parse font", "error", err)
+			return
 		}
 
 		face := truetype.NewFace(font, &truetype.Options{Size: 16})
@@ -348,73 +499,233 @@ func Handler(res http.ResponseWriter, req *http.Request) {
 			gc.SetColor(color.NRGBA{0, 0, 0, 255})
 			gc.DrawString(fmt.Sprintf("%d", c+1), (float64)(list[c].X*5-2), (float64)(list[c].Y*5+8))
 		}
-		bot.RespondPhoto(body.Message, composite)
+		r.mapImage(composite)
 
 		for c := range list {
-			bot.Respond(body.Message, fmt.Sprintf("\\/path\\_chest\\_%d path to chest at \\{%d, %d\\} /at\\_%d\\_%d", c+1, list[c].X, list[c].Y, list[c].X, list[c].Y))
+			r.info(tr.Markdown("list.chest", mdv2.Command("path", "chest", c+1), mdv2.Coordinate(list[c].X, list[c].Y), mdv2.Command("at", list[c].X, list[c].Y)))
+		}
+	} else if strings.HasPrefix(body.Message.Text, "/settings") {
+		commandsTotal.WithLabelValues("settings").Inc()
+		if err := a.sendSettings(ctx, body.Message.Chat.ID, settings, tr); err != nil {
+			log.Error("could not send settings", "error", err)
+			r.reply(tr.T("settings.show_failed"))
 		}
 	} else if strings.HasPrefix(body.Message.Text, "/at") {
+		commandsTotal.WithLabelValues("at").Inc()
 		re, _ := regexp.Compile(`\/at[ _](\d+)[ ,_]+(\d+)`)
 		matches := re.FindAllStringSubmatch(body.Message.Text, -1)
-		maze, _, _, err := getPlayerState(body.Message)
-
-		if err != nil {
-			bot.Respond(body.Message, fmt.Sprint(err))
+		// a location can be set without a scribble, only the map is needed
+		maze, _, _, err := a.getPlayerState(ctx, body.Message)
+		if maze == nil {
+			r.reply(tr.Error(err))
+			return
 		}
 
 		if matches == nil || matches[0][1] == "" || matches[0][2] == "" {
-			bot.Respond(body.Message, "Could not parse command")
+			r.reply(tr.T("command.unparsed"))
 			return
 		}
 
 		x, _ := strconv.Atoi(matches[0][1])
 		y, _ := strconv.Atoi(matches[0][2])
 
-		if x >= len(maze.Pixels[0]) || y >= len(maze.Pixels) {
-			bot.Respond(body.Message, "Position is outside of the maze.")
+		location := cwmaze.Point{X: x, Y: y}
+		// a path can't start in a wall
+		if !maze.Pixels.Walkable(location) {
+			r.reply(tr.T("location.outside"))
 			return
 		}
 
-		location := cwmaze.Point{X: x, Y: y}
 		locationJson, err := json.Marshal(location)
 		if err != nil {
-			fmt.Println(err)
+			log.Error("could not encode location", "error", err)
 		}
 
-		err = redisClient.Set(ctx, fmt.Sprintf("%d-Location", body.Message.Chat.ID), locationJson, 0).Err()
+		err = a.redis.Set(ctx, fmt.Sprintf("%d-Location", body.Message.Chat.ID), locationJson, 0).Err()
 		if err != nil {
-			fmt.Println(err)
-			bot.Respond(body.Message, "Failed to save location")
+			log.Error("could not save location", "error", err)
+			r.reply(tr.T("location.save_failed"))
 		} else {
-			bot.Respond(body.Message, tgbot.EscapeString(fmt.Sprintf("Location set: %s", location)))
+			r.reply(tr.Markdown("location.set", mdv2.Coordinate(location.X, location.Y)))
 		}
 	} else {
-		bot.Respond(body.Message, "Try forwarding a map or scribble of a dungeon")
+		commandsTotal.WithLabelValues("unknown").Inc()
+		r.reply(tr.T("command.unknown"))
 	}
 
-	// log a confirmation message if the message is sent successfully
-	fmt.Println("reply sent")
+	log.Debug("handled update")
+}
+
+var (
+	errNoMap      = errors.New("no map found, please forward map before taking other actions")
+	errNoScribble = errors.New("no scribble found, please forward scribble before taking other actions")
+	errNotLocated = errors.New("the last scribble matched nowhere on the map")
+)
+
+// closestMatches is how many near matches are shown for a scribble that matches nowhere
+const closestMatches = 3
+
+// locateCommand is /locate at the start of a message, addressed to any bot in groups
+var locateCommand = regexp.MustCompile(`^/locate(@\w+)?`)
+
+// scribbleIn finds the scribble in a message. A single row only counts after /locate,
+// so a chat line with a few squares in it isn't taken for a scribble. The command is
+// cut off first, so a row on the same line as /locate is part of the scribble.
+func scribbleIn(text string) string {
+	minRows := 2
+	if command := locateCommand.FindString(text); command != "" {
+		text = text[len(command):]
+		minRows = 1
+	}
+	return cwmaze.FindScribble(text, minRows)
 }
 
-func getPlayerState(message tgbot.Message) (*cwmaze.Maze, *cwmaze.Scribble, *cwmaze.Point, error) {
-	maze := &cwmaze.Maze{}
-	if err := getFromRedis(maze, fmt.Sprint(message.Chat.ID)); err != nil {
-		return nil, nil, nil, errors.New("no map found, please forward map before taking other actions")
+// scribbleMarker starts a scribble forwarded from the game's English client
+const scribbleMarker = "You stopped and tried to mark your way on paper."
+
+func (a *App) getPlayerState(ctx context.Context, message tgbot.Message) (*cwmaze.Maze, *cwmaze.Scribble, *cwmaze.Point, error) {
+	maze, _, err := a.getChatMap(ctx, message.Chat.ID)
+	if err != nil {
+		return nil, nil, nil, errNoMap
 	}
 
 	scribble := &cwmaze.Scribble{}
-	if err := getFromRedis(scribble, fmt.Sprintf("%d-Scribble", message.Chat.ID)); err != nil {
-		return maze, nil, nil, errors.New("no scribble found, please forward scribble before taking other actions")
+	if err := getFromRedis(ctx, a.redis, scribble, fmt.Sprintf("%d-Scribble", message.Chat.ID)); err != nil {
+		return maze, nil, nil, errNoScribble
 	}
 
 	location := &cwmaze.Point{}
-	if err := getFromRedis(location, fmt.Sprintf("%d-Location", message.Chat.ID)); err != nil {
+	if err := getFromRedis(ctx, a.redis, location, fmt.Sprintf("%d-Location", message.Chat.ID)); err != nil {
 		location = nil
 	}
+	if location == nil && len(scribble.Matches) == 0 {
+		return maze, scribble, nil, errNotLocated
+	}
 
 	return maze, scribble, location, nil
 }
 
+// responder collects the replies to a single update, in the chat's language and reply
+// mode, and sends them together once the update is handled
+type responder struct {
+	app      *App
+	message  tgbot.Message
+	settings Settings
+	tr       translator
+	log      *slog.Logger
+
+	texts  []mdv2.Text
+	images []image.Image
+	// mapView is set when the image is the chat's map view
+	mapView bool
+}
+
+// reply adds MarkdownV2 text to the reply
+func (r *responder) reply(text mdv2.Text) {
+	r.texts = append(r.texts, text)
+}
+
+// info adds informational text, unless the chat only wants images
+func (r *responder) info(text mdv2.Text) {
+	if r.settings.Replies == repliesImage {
+		return
+	}
+	r.reply(text)
+}
+
+// image adds an image, unless the chat only wants text
+func (r *responder) image(img image.Image) {
+	if r.settings.Replies == repliesText {
+		return
+	}
+	r.images = append(r.images, img)
+}
+
+// mapImage adds an image of the player's view of the map, which updates the chat's
+// last map view rather than posting a new one if the chat prefers
+func (r *responder) mapImage(img image.Image) {
+	r.image(img)
+	r.mapView = true
+}
+
+// flush sends everything collected so far: the images as a photo or album, captioned
+// with the text if it fits, and otherwise the text in as few messages as possible
+func (r *responder) flush(ctx context.Context) {
+	chatID := r.message.Chat.ID
+	texts, images := r.texts, r.images
+	r.texts, r.images = nil, nil
+
+	var caption mdv2.Text
+	if len(images) > 0 {
+		if text := mdv2.Join("\n\n", texts...); mdv2.Len(text) <= maxCaptionLength {
+			caption, texts = text, nil
+		}
+	}
+
+	if r.mapView && len(images) == 1 && r.settings.Maps == mapsEdit {
+		if messageID := r.app.getMapView(ctx, chatID, r.log); messageID != 0 {
+			err := r.app.tg.EditMessageMedia(ctx, chatID, messageID, images[0], caption)
+			if err == nil || isNotModified(err) {
+				images = nil
+			} else {
+				// most likely the message was deleted, so post a new one
+				r.log.Warn("could not update map view", "message_id", messageID, "error", err)
+			}
+		}
+	}
+
+	for len(images) > 0 {
+		group := images[:min(len(images), maxMediaGroup)]
+		images = images[len(group):]
+
+		var err error
+		if len(group) == 1 {
+			var sent sentMessage
+			sent, err = r.app.tg.SendPhoto(ctx, chatID, group[0], caption)
+			if err == nil && r.mapView {
+				if err := r.app.saveMapView(ctx, chatID, sent.MessageID); err != nil {
+					r.log.Error("could not save map view", "error", err)
+				}
+			}
+		} else {
+			_, err = r.app.tg.SendMediaGroup(ctx, chatID, group, caption)
+		}
+		if err != nil {
+			r.log.Error("failed to send image", "images", len(group), "error", err)
+		}
+		caption = ""
+	}
+
+	for _, text := range batchTexts(texts, maxMessageLength) {
+		if _, err := r.app.tg.SendMessage(ctx, chatID, text); err != nil {
+			r.log.Error("failed to send reply", "error", err)
+		}
+	}
+}
+
+// batchTexts joins texts into as few messages as fit within limit. A single text
+// longer than limit is left on its own, MarkdownV2 can't be split safely.
+func batchTexts(texts []mdv2.Text, limit int) []mdv2.Text {
+	var batches []mdv2.Text
+	for _, text := range texts {
+		last := len(batches) - 1
+		if last >= 0 && mdv2.Len(batches[last])+2+mdv2.Len(text) <= limit {
+			batches[last] = mdv2.Join("\n\n", batches[last], text)
+		} else {
+			batches = append(batches, text)
+		}
+	}
+	return batches
+}
+
+// renderScribble draws a parsed scribble large enough to make out each tile
+func renderScribble(s cwmaze.Scribble) image.Image {
+	const scale = 8
+	img := image.NewRGBA(image.Rect(0, 0, s.Bounds().Dx()*scale, s.Bounds().Dy()*scale))
+	xdraw.NearestNeighbor.Scale(img, img.Bounds(), s, s.Bounds(), xdraw.Src, nil)
+	return img
+}
+
 func drawPlayerBox(composite *image.RGBA, player *cwmaze.Point) {
 	gc := gg.NewContextForRGBA(composite)
 
@@ -423,16 +734,14 @@ func drawPlayerBox(composite *image.RGBA, player *cwmaze.Point) {
 	gc.Fill()
 }
 
-func getFromRedis[T any](obj *T, key string) error {
-	jsonVal, err := redisClient.Get(ctx, key).Result()
+func getFromRedis[T any](ctx context.Context, client *redis.Client, obj *T, key string) error {
+	jsonVal, err := client.Get(ctx, key).Result()
 	if err != nil {
-		fmt.Printf("error fetching %s from redis: %s\n", key, err)
 		return err
 	}
 
 	if err := json.NewDecoder(strings.NewReader(jsonVal)).Decode(obj); err != nil {
-		fmt.Println("could not decode request body", err)
-		return err
+		return fmt.Errorf("could not decode %s: %w", key, err)
 	}
 
 	return nil
@@ -445,29 +754,57 @@ func getEnv(key string, fallback string) string {
 	return fallback
 }
 
-var redisClient *redis.Client
-var bot tgbot.Bot
-var ctx = context.Background()
-
 func main() {
+	env := getEnv("GO_ENV", "development")
+	logger := newLogger(env, getEnv("LOG_LEVEL", ""))
+	slog.SetDefault(logger)
+
 	port := getEnv("PORT", "3000")
+	metricsPort := getEnv("METRICS_PORT", "9091")
 
 	redisUrl := getEnv("REDIS_URL", "redis://localhost:6379")
-	opt, _ := redis.ParseURL(redisUrl)
-	redisClient = redis.NewClient(opt)
+	opt, err := redis.ParseURL(redisUrl)
+	if err != nil {
+		logger.Error("invalid REDIS_URL", "error", err)
+		os.Exit(1)
+	}
+	redisClient := redis.NewClient(opt)
 
-	pong, err := redisClient.Ping(context.Background()).Result()
-	fmt.Println(pong, err)
+	if err := redisClient.Ping(context.Background()).Err(); err != nil {
+		logger.Error("could not connect to redis", "error", err)
+		os.Exit(1)
+	}
 
-	bot = tgbot.Bot{API_KEY: getEnv("TG_API_KEY", "abcd:1234")}
-	if getEnv("GO_ENV", "development") == "production" {
-		_, err = bot.SetWebhook("https://happydungeon.fly.dev/" + getEnv("TG_WEBHOOK", ""))
-		if err != nil {
-			fmt.Println(err)
-		} else {
-			fmt.Println("Webhook set")
+	bot := tgbot.Bot{API_KEY: getEnv("TG_API_KEY", "abcd:1234")}
+	tg := newTelegram(bot, getEnv("TG_API_URL", "https://api.telegram.org"))
+	tg.fileIDs = redisFileIDs{redisClient}
+
+	config := Config{
+		Env:           env,
+		WebhookURL:    "https://happydungeon.fly.dev",
+		WebhookPath:   "/webhook",
+		WebhookSecret: getEnv("TG_WEBHOOK_SECRET", defaultWebhookSecret(bot.API_KEY)),
+	}
+	if suffix := getEnv("TG_WEBHOOK", ""); suffix != "" {
+		config.WebhookPath += "/" + suffix
+	}
+	config.Workers, _ = strconv.Atoi(getEnv("WORKERS", "4"))
+	config.QueueSize, _ = strconv.Atoi(getEnv("QUEUE_SIZE", "100"))
+
+	if env == "production" {
+		if err := tg.SetWebhook(context.Background(), config.WebhookURL+config.WebhookPath, config.WebhookSecret); err != nil {
+			logger.Error("could not set webhook", "error", err)
+			os.Exit(1)
 		}
+		// the path may end in the secret TG_WEBHOOK suffix, keep it out of the logs
+		logger.Info("webhook set", "url", config.WebhookURL)
 	}
 
-	http.ListenAndServe(":"+port, http.HandlerFunc(Handler))
+	app := newApp(config, redisClient, tg, logger)
+	prometheus.MustRegister(app.sessionsGauge())
+
+	if err := app.serve(newServer(":"+port, app.newMux()), newServer(":"+metricsPort, newMetricsMux())); err != nil {
+		logger.Error("server failed", "error", err)
+		os.Exit(1)
+	}
 }
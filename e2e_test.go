@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	cwmaze "dungeonbot/maze"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lawn-chair/gobot/tgbot"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	testChatID = 5
+	testSecret = "test-secret"
+	testMap    = "maze/test.jpeg"
+)
+
+// harness runs the bot against a fake Bot API and an in-memory Redis, posting
+// updates to the webhook the way Telegram does
+type harness struct {
+	t     *testing.T
+	api   *fakeBotAPI
+	redis *miniredis.Miniredis
+	app   *App
+	mux   http.Handler
+
+	nextUpdateID int64
+}
+
+func newHarness(t *testing.T) *harness {
+	h := &harness{t: t, api: newFakeBotAPI(t), redis: miniredis.RunT(t)}
+	redisClient := redis.NewClient(&redis.Options{Addr: h.redis.Addr()})
+	tg := newTelegram(tgbot.Bot{API_KEY: testAPIKey}, h.api.server.URL)
+	tg.fileIDs = redisFileIDs{redisClient}
+	tg.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+
+	config := Config{WebhookPath: "/webhook", WebhookSecret: testSecret, Workers: 2, QueueSize: 10}
+	h.app = newApp(config, redisClient, tg, slog.Default())
+	t.Cleanup(func() { h.app.updates.Close(context.Background()) })
+	h.mux = h.app.newMux()
+	return h
+}
+
+// post sends a raw update to the webhook and waits for the bot to handle it
+func (h *harness) post(body []byte) int {
+	h.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+	req.Header.Set(secretTokenHeader, testSecret)
+	res := httptest.NewRecorder()
+	h.mux.ServeHTTP(res, req)
+
+	// closing the dispatcher waits for the queued updates to be handled
+	if err := h.app.updates.Close(context.Background()); err != nil {
+		h.t.Fatal(err)
+	}
+	h.app.updates = newDispatcher(h.app.config.Workers, h.app.config.QueueSize, h.app.handleUpdate, h.app.log)
+	return res.Code
+}
+
+// send posts an update with the next update_id, with fields such as message or callback_query
+func (h *harness) send(fields map[string]any) {
+	h.t.Helper()
+	h.nextUpdateID++
+	fields["update_id"] = h.nextUpdateID
+	body, err := json.Marshal(fields)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if status := h.post(body); status != http.StatusOK {
+		h.t.Fatalf("webhook answered %d", status)
+	}
+}
+
+// message is a message in the test chat from a user, with the given fields
+func message(fields map[string]any) map[string]any {
+	msg := map[string]any{
+		"message_id": 1,
+		"chat":       map[string]any{"id": testChatID},
+		"from":       map[string]any{"id": testChatID, "language_code": "en"},
+	}
+	for name, value := range fields {
+		msg[name] = value
+	}
+	return map[string]any{"message": msg}
+}
+
+func (h *harness) sendText(text string) {
+	h.t.Helper()
+	h.send(message(map[string]any{"text": text}))
+}
+
+// forwardMap sends the test map as a photo, returning the file_id it was sent as
+func (h *harness) forwardMap() string {
+	h.t.Helper()
+	data, err := os.ReadFile(testMap)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return h.forwardPhoto(data)
+}
+
+// forwardPhoto sends an image as a photo, returning the file_id it was sent as
+func (h *harness) forwardPhoto(data []byte) string {
+	h.t.Helper()
+	fileID, _ := h.api.addFile(data)
+	h.send(message(map[string]any{"photo": h.api.photoSizes(fileID)}))
+	return fileID
+}
+
+// get reads a key the bot stored
+func (h *harness) get(key string) string {
+	h.t.Helper()
+	value, err := h.redis.Get(key)
+	if err != nil {
+		h.t.Fatalf("%s: %v", key, err)
+	}
+	return value
+}
+
+// only returns the single call received, failing unless it was to method
+func (h *harness) only(method string) botCall {
+	h.t.Helper()
+	calls := h.api.Calls()
+	if len(calls) != 1 || calls[0].Method != method {
+		var got []string
+		for _, call := range calls {
+			got = append(got, call.Method)
+		}
+		h.t.Fatalf("bot called %v, want a single %s", got, method)
+	}
+	return calls[0]
+}
+
+func loadTestMap(t *testing.T) *cwmaze.Maze {
+	f, err := os.Open(testMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &cwmaze.Maze{}
+	m.Load(img)
+	return m
+}
+
+// scribbleGlyphs are how Chat Wars draws tiles in a scribble
+var scribbleGlyphs = map[uint8]string{0: "⬛", 1: "⬜", 2: "🟦", 3: "🟩", 4: "🟫", 5: "🟧", 6: "🟪", 7: "🟥"}
+
+// scribbleAt draws the part of the map around the player like Chat Wars does,
+// picking the first path tile where that matches only one place in the map
+func scribbleAt(t *testing.T, m *cwmaze.Maze) (string, cwmaze.Point) {
+	const radius = 4
+	for y := radius; y < len(m.Pixels)-radius; y++ {
+		for x := radius; x < len(m.Pixels[y])-radius; x++ {
+			if m.Pixels[y][x] != 1 {
+				continue
+			}
+
+			var rows []string
+			for sy := y - radius; sy <= y+radius; sy++ {
+				var row strings.Builder
+				for sx := x - radius; sx <= x+radius; sx++ {
+					glyph, found := scribbleGlyphs[m.Pixels[sy][sx]]
+					switch {
+					case sx == x && sy == y:
+						glyph = "🟨"
+					case !found:
+						glyph = "❓"
+					}
+					row.WriteString(glyph)
+				}
+				rows = append(rows, row.String())
+			}
+
+			scribble := strings.Join(rows, "\n")
+			if len(m.SearchByScribble(scribble).Matches) == 1 {
+				return scribble, cwmaze.Point{X: x, Y: y}
+			}
+		}
+	}
+	t.Fatal("no scribble in the test map matches only one place")
+	return "", cwmaze.Point{}
+}
+
+func TestForwardMap(t *testing.T) {
+	h := newHarness(t)
+	m := loadTestMap(t)
+	fingerprint := m.Fingerprint()
+
+	fileID := h.forwardMap()
+
+	if calls := h.api.Calls("getFile"); len(calls) != 1 || calls[0].Params["file_id"] != fileID {
+		t.Errorf("getFile calls = %v, want one for %s", calls, fileID)
+	}
+	photos := h.api.Calls("sendPhoto")
+	if len(photos) != 1 || !strings.Contains(photos[0].Params["caption"], "This map has 48 chests") {
+		t.Fatalf("sendPhoto calls = %v, want the map with its summary", photos)
+	}
+	if photos[0].Files["photo"] == nil {
+		t.Errorf("the first map render was not uploaded")
+	}
+
+	if got := h.get(chatMapKey(testChatID)); got != fingerprint {
+		t.Errorf("chat is on map %s, want %s", got, fingerprint)
+	}
+	if !h.redis.Exists(mapKey(fingerprint)) {
+		t.Errorf("map %s is not in the library", fingerprint)
+	}
+	stored, err := cwmaze.Decode([]byte(h.get(mapKey(fingerprint))))
+	if err != nil || stored.Fingerprint() != fingerprint {
+		t.Errorf("library holds a different map: %v", err)
+	}
+
+	// the same photo again is neither downloaded nor decoded, and the render isn't uploaded again
+	h.api.Reset()
+	h.send(message(map[string]any{"photo": h.api.photoSizes(fileID)}))
+
+	call := h.only("sendPhoto")
+	if call.Files["photo"] != nil || call.Params["photo"] == "" {
+		t.Errorf("map render was uploaded again instead of sent by file_id")
+	}
+	if !strings.Contains(call.Params["caption"], "already on") {
+		t.Errorf("caption = %q, want the map kept", call.Params["caption"])
+	}
+}
+
+func TestScribbleAndPath(t *testing.T) {
+	h := newHarness(t)
+	m := loadTestMap(t)
+	scribble, player := scribbleAt(t, m)
+
+	h.forwardMap()
+	h.api.Reset()
+	h.sendText("You stopped and tried to mark your way on paper.\n\n" + scribble + "\n\nSome other text")
+
+	call := h.only("sendPhoto")
+	wantPlayer := fmt.Sprintf("Player at: \\{%d, %d\\}", player.X, player.Y)
+	if !strings.Contains(call.Params["caption"], "Location Found") || !strings.Contains(call.Params["caption"], wantPlayer) {
+		t.Errorf("caption = %q, want the player at %s", call.Params["caption"], player)
+	}
+	if !h.redis.Exists(fmt.Sprintf("%d-Scribble", testChatID)) {
+		t.Errorf("scribble was not saved")
+	}
+	mapView := h.get(mapViewKey(testChatID))
+
+	// the route is drawn on the map the scribble was shown on
+	h.api.Reset()
+	h.sendText("/path_chest")
+
+	call = h.only("editMessageMedia")
+	if call.Params["message_id"] != mapView {
+		t.Errorf("edited message %s, want the map view %s", call.Params["message_id"], mapView)
+	}
+	if !strings.Contains(call.Params["media"], "Path to") {
+		t.Errorf("media = %s, want a caption with the path", call.Params["media"])
+	}
+
+	h.api.Reset()
+	h.sendText(fmt.Sprintf("/at_%d_%d", player.X, player.Y+1))
+
+	call = h.only("sendMessage")
+	if want := fmt.Sprintf("Location set: \\{%d, %d\\}", player.X, player.Y+1); call.Params["text"] != want {
+		t.Errorf("text = %q, want %q", call.Params["text"], want)
+	}
+	if got := h.get(fmt.Sprintf("%d-Location", testChatID)); got != fmt.Sprintf(`{"X":%d,"Y":%d}`, player.X, player.Y+1) {
+		t.Errorf("saved location %s", got)
+	}
+}
+
+func TestPathInvalidNumber(t *testing.T) {
+	h := newHarness(t)
+	m := loadTestMap(t)
+	scribble, _ := scribbleAt(t, m)
+
+	h.forwardMap()
+	h.sendText(scribble)
+	// standing on a mob leaves one fewer to walk to
+	h.sendText(fmt.Sprintf("/at_%d_%d", m.Mobs[0].X, m.Mobs[0].Y))
+
+	cases := []struct {
+		command string
+		want    string
+	}{
+		{"/path_mob_0", "Invalid mob number: 0"},
+		{"/path_chest_0", "Invalid chest number: 0"},
+		{fmt.Sprintf("/path_mob_%d", len(m.Mobs)), fmt.Sprintf("Invalid mob number: %d", len(m.Mobs))},
+		{fmt.Sprintf("/path_chest_%d", len(m.Chests)+1), fmt.Sprintf("Invalid chest number: %d", len(m.Chests)+1)},
+	}
+	for _, c := range cases {
+		h.api.Reset()
+		h.sendText(c.command)
+		if call := h.only("sendMessage"); call.Params["text"] != c.want {
+			t.Errorf("%s: text = %q, want %q", c.command, call.Params["text"], c.want)
+		}
+	}
+}
+
+func TestPathWithoutChests(t *testing.T) {
+	h := newHarness(t)
+	m := loadTestMap(t)
+	for _, chest := range m.Chests {
+		m.Pixels[chest.Y][chest.X] = 1
+	}
+	var data bytes.Buffer
+	if err := png.Encode(&data, m); err != nil {
+		t.Fatal(err)
+	}
+	// the scribble has to match the map as the bot reads it
+	img, err := png.Decode(bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := &cwmaze.Maze{}
+	forwarded.Load(img)
+	scribble, _ := scribbleAt(t, forwarded)
+
+	h.forwardPhoto(data.Bytes())
+	h.sendText(scribble)
+	h.api.Reset()
+	h.sendText("/path_chest")
+
+	if call := h.only("sendMessage"); call.Params["text"] != "Invalid chest number: 1" {
+		t.Errorf("text = %q, want the invalid chest", call.Params["text"])
+	}
+}
+
+func TestCommandsWithoutMap(t *testing.T) {
+	h := newHarness(t)
+
+	h.sendText("/mobs")
+	if call := h.only("sendMessage"); !strings.Contains(call.Params["text"], "No map found") {
+		t.Errorf("text = %q, want no map", call.Params["text"])
+	}
+
+	h.api.Reset()
+	h.sendText("hello")
+	if call := h.only("sendMessage"); !strings.Contains(call.Params["text"], "Try forwarding a map") {
+		t.Errorf("text = %q, want the help", call.Params["text"])
+	}
+
+	if sessions := h.app.countActiveSessions(); sessions != 1 {
+		t.Errorf("%v active sessions, want 1", sessions)
+	}
+}
+
+func TestDuplicateUpdate(t *testing.T) {
+	h := newHarness(t)
+
+	body := []byte(`{"update_id":42,"message":{"message_id":1,"chat":{"id":5},"text":"hello"}}`)
+	for i := 0; i < 2; i++ {
+		if status := h.post(body); status != http.StatusOK {
+			t.Fatalf("webhook answered %d", status)
+		}
+	}
+	h.only("sendMessage")
+	if ttl := h.redis.TTL(updateKey(42)); ttl != updateTTL {
+		t.Errorf("handled update kept for %v, want %v", ttl, updateTTL)
+	}
+}
+
+func TestUnhandledClaimExpires(t *testing.T) {
+	h := newHarness(t)
+
+	// claimed when queued, but never handled
+	if claimed, err := h.app.claimUpdate(context.Background(), 43); err != nil || !claimed {
+		t.Fatalf("claimUpdate = %v, %v", claimed, err)
+	}
+	h.redis.FastForward(claimTTL)
+
+	body := []byte(`{"update_id":43,"message":{"message_id":1,"chat":{"id":5},"text":"hello"}}`)
+	if status := h.post(body); status != http.StatusOK {
+		t.Fatalf("webhook answered %d", status)
+	}
+	h.only("sendMessage")
+}
+
+func TestSettingsKeyboard(t *testing.T) {
+	h := newHarness(t)
+
+	h.sendText("/settings")
+	call := h.only("sendMessage")
+	if !strings.Contains(call.Params["reply_markup"], "settings:list:3") {
+		t.Fatalf("reply_markup = %s, want the settings keyboard", call.Params["reply_markup"])
+	}
+
+	h.api.Reset()
+	h.send(map[string]any{"callback_query": map[string]any{
+		"id":      "query",
+		"from":    map[string]any{"id": testChatID, "language_code": "en"},
+		"data":    "settings:list:3",
+		"message": map[string]any{"message_id": 101, "chat": map[string]any{"id": testChatID}},
+	}})
+
+	if calls := h.api.Calls("editMessageText"); len(calls) != 1 || !strings.Contains(calls[0].Params["text"], "List length: 3") {
+		t.Errorf("editMessageText calls = %v, want the new list length", calls)
+	}
+	if calls := h.api.Calls("answerCallbackQuery"); len(calls) != 1 || calls[0].Params["callback_query_id"] != "query" {
+		t.Errorf("answerCallbackQuery calls = %v", calls)
+	}
+	if settings := h.app.getSettings(context.Background(), testChatID, slog.Default()); settings.ListLength != 3 {
+		t.Errorf("saved list length %d, want 3", settings.ListLength)
+	}
+}
+
+func TestSetWebhookWithFakeAPI(t *testing.T) {
+	h := newHarness(t)
+
+	if err := h.app.tg.SetWebhook(context.Background(), "https://example.com/webhook", testSecret); err != nil {
+		t.Fatal(err)
+	}
+	call := h.only("setWebhook")
+	if call.Params["url"] != "https://example.com/webhook" || call.Params["secret_token"] != testSecret {
+		t.Errorf("setWebhook params = %v", call.Params)
+	}
+}
+
+func TestAtInvalidPosition(t *testing.T) {
+	h := newHarness(t)
+
+	h.sendText("/at_1_1")
+	if call := h.only("sendMessage"); !strings.Contains(call.Params["text"], "No map found") {
+		t.Errorf("text = %q, want no map", call.Params["text"])
+	}
+
+	h.forwardMap()
+	// the maze is 161 tiles wide and high, and walled in
+	for _, command := range []string{"/at_161_3", "/at_3_161", "/at_0_0", "/at_2_2"} {
+		h.api.Reset()
+		h.sendText(command)
+		if call := h.only("sendMessage"); call.Params["text"] != "Position is a wall or outside of the maze\\." {
+			t.Errorf("%s: text = %q, want the position rejected", command, call.Params["text"])
+		}
+	}
+	if h.redis.Exists(fmt.Sprintf("%d-Location", testChatID)) {
+		t.Errorf("invalid location was saved")
+	}
+}
+
+func TestScribbleMatchesNowhere(t *testing.T) {
+	h := newHarness(t)
+	m := loadTestMap(t)
+	scribble, player := scribbleAt(t, m)
+
+	// the first tile of the scribble drawn wrong, as if the map changed there
+	first, _ := utf8.DecodeRuneInString(scribble)
+	wrong := "⬛"
+	if string(first) == wrong {
+		wrong = "⬜"
+	}
+	misdrawn := wrong + scribble[utf8.RuneLen(first):]
+
+	h.forwardMap()
+	h.api.Reset()
+	h.sendText("You stopped and tried to mark your way on paper.\n\n" + misdrawn)
+
+	call := h.only("sendMediaGroup")
+	if !strings.Contains(call.Params["media"], "doesn't match anywhere") || !strings.Contains(call.Params["media"], fmt.Sprintf("Closest places: \\\\{%d, %d\\\\} \\\\(tiles that differ: 1\\\\)", player.X, player.Y)) {
+		t.Errorf("media = %s, want the closest places", call.Params["media"])
+	}
+	if len(call.Files) != 2 {
+		t.Errorf("sent %d images, want the map and the scribble", len(call.Files))
+	}
+
+	var stored cwmaze.Scribble
+	if err := json.Unmarshal([]byte(h.get(fmt.Sprintf("%d-Scribble", testChatID))), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Matches) != 0 || len(stored.Closest) == 0 {
+		t.Errorf("stored scribble has matches %v and closest %v, want only closest", stored.Matches, stored.Closest)
+	}
+
+	h.api.Reset()
+	h.sendText("/path")
+	if call := h.only("sendMessage"); !strings.Contains(call.Params["text"], "didn't match the map") {
+		t.Errorf("text = %q, want the scribble to have failed", call.Params["text"])
+	}
+}
+
+func TestScribbleUnknownGlyphs(t *testing.T) {
+	h := newHarness(t)
+	m := loadTestMap(t)
+	scribble, _ := scribbleAt(t, m)
+
+	h.forwardMap()
+	h.api.Reset()
+	h.sendText("You stopped and tried to mark your way on paper.\n\n" + strings.Replace(scribble, "⬛", "🆕", 1))
+
+	call := h.only("sendPhoto")
+	if !strings.Contains(call.Params["caption"], "weren't recognized, they were taken to match any tile: 🆕") {
+		t.Errorf("caption = %q, want the unknown glyph", call.Params["caption"])
+	}
+	if !strings.Contains(call.Params["caption"], "Location Found") {
+		t.Errorf("caption = %q, want the location found anyway", call.Params["caption"])
+	}
+}
+
+func TestLocate(t *testing.T) {
+	h := newHarness(t)
+	m := loadTestMap(t)
+	scribble, player := scribbleAt(t, m)
+	wantPlayer := fmt.Sprintf("Player at: \\{%d, %d\\}", player.X, player.Y)
+
+	// pasted with a space between the glyphs
+	var spaced []string
+	for _, row := range strings.Split(scribble, "\n") {
+		spaced = append(spaced, strings.Join(strings.Split(row, ""), " "))
+	}
+
+	h.forwardMap()
+	messages := []string{
+		"/locate\n" + scribble,
+		"/locate@dungeonbot " + scribble,
+		"Ты остановился и попытался отметить путь на бумаге.\n\n" + scribble + "\n\nЕщё текст",
+		scribble,
+		strings.Join(spaced, "\n"),
+	}
+	for i, text := range messages {
+		h.api.Reset()
+		h.sendText(text)
+
+		// the first result posts the map view, the others update it
+		var caption string
+		if i == 0 {
+			caption = h.only("sendPhoto").Params["caption"]
+		} else {
+			var media inputMediaPhoto
+			json.Unmarshal([]byte(h.only("editMessageMedia").Params["media"]), &media)
+			caption = string(media.Caption)
+		}
+		if !strings.Contains(caption, wantPlayer) {
+			t.Errorf("%q: caption = %q, want the player found", text, caption)
+		}
+	}
+
+	h.api.Reset()
+	h.sendText("/locate")
+	if call := h.only("sendMessage"); !strings.Contains(call.Params["text"], "Send /locate with the scribble") {
+		t.Errorf("text = %q, want how to use /locate", call.Params["text"])
+	}
+
+	// a chat line with a few squares in it is not a scribble
+	h.api.Reset()
+	h.sendText("🟩🟩🟩")
+	if call := h.only("sendMessage"); !strings.Contains(call.Params["text"], "Try forwarding a map") {
+		t.Errorf("text = %q, want the help", call.Params["text"])
+	}
+}
+
+func TestScribbleIn(t *testing.T) {
+	cases := []struct {
+		text, want string
+	}{
+		{"/locate 🟩🟫🟩", "🟩🟫🟩"},
+		{"/locate@dungeonbot 🟩🟫🟩\n🟫🟫🟩", "🟩🟫🟩\n🟫🟫🟩"},
+		{"/locate\n🟩🟫🟩", "🟩🟫🟩"},
+		{"🟩🟫🟩", ""},
+		{"look\n🟩🟫🟩\n🟫🟫🟩", "🟩🟫🟩\n🟫🟫🟩"},
+		{"/locate", ""},
+	}
+	for _, c := range cases {
+		if got := scribbleIn(c.text); got != c.want {
+			t.Errorf("scribbleIn(%q) = %q, want %q", c.text, got, c.want)
+		}
+	}
+}
+
+func TestEditedScribble(t *testing.T) {
+	h := newHarness(t)
+	m := loadTestMap(t)
+	scribble, player := scribbleAt(t, m)
+
+	h.forwardMap()
+	edited := func(text string) map[string]any {
+		update := message(map[string]any{"text": text, "edit_date": 1700000000})
+		return map[string]any{"edited_message": update["message"]}
+	}
+
+	h.api.Reset()
+	h.send(edited(scribble))
+	wantPlayer := fmt.Sprintf("Player at: \\{%d, %d\\}", player.X, player.Y)
+	if call := h.only("sendPhoto"); !strings.Contains(call.Params["caption"], wantPlayer) {
+		t.Errorf("caption = %q, want the corrected scribble searched", call.Params["caption"])
+	}
+
+	// edits that aren't scribbles get no answer
+	h.api.Reset()
+	h.send(edited("hello"))
+	if calls := h.api.Calls(); len(calls) != 0 {
+		t.Errorf("bot answered an edit without a scribble: %v", calls)
+	}
+}
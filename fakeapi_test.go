@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testAPIKey = "1234:test"
+
+// botCall is a Bot API call the fake received
+type botCall struct {
+	Method string
+	// Params holds the call's parameters, strings as they are and anything else as JSON
+	Params map[string]string
+	// Files holds the uploaded files by field name
+	Files map[string][]byte
+}
+
+type fakeFile struct {
+	uniqueID string
+	path     string
+	data     []byte
+}
+
+// fakeBotAPI is an in-process Bot API that records every call and answers like
+// Telegram would, keeping the files it was sent so they can be downloaded again
+type fakeBotAPI struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu            sync.Mutex
+	calls         []botCall
+	files         map[string]fakeFile // by file_id
+	nextMessageID int64
+	nextFileID    int
+}
+
+func newFakeBotAPI(t *testing.T) *fakeBotAPI {
+	f := &fakeBotAPI{t: t, files: make(map[string]fakeFile), nextMessageID: 100}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// addFile stores data as if a user had sent it, returning its file_id and file_unique_id
+func (f *fakeBotAPI) addFile(data []byte) (string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addFileLocked(data)
+}
+
+func (f *fakeBotAPI) addFileLocked(data []byte) (string, string) {
+	f.nextFileID++
+	file := fakeFile{
+		uniqueID: fmt.Sprintf("unique%d", f.nextFileID),
+		path:     fmt.Sprintf("photos/file_%d.jpg", f.nextFileID),
+		data:     data,
+	}
+	fileID := fmt.Sprintf("file%d", f.nextFileID)
+	f.files[fileID] = file
+	return fileID, file.uniqueID
+}
+
+// photoSizes is the photo field of a message with the file in it
+func (f *fakeBotAPI) photoSizes(fileID string) []photoSize {
+	return []photoSize{
+		{FileID: fileID + "-thumb", FileUniqueID: f.files[fileID].uniqueID + "-thumb", Width: 90, Height: 90},
+		{FileID: fileID, FileUniqueID: f.files[fileID].uniqueID, Width: 805, Height: 805},
+	}
+}
+
+// Calls returns the calls received so far, only those to the given methods if any are given
+func (f *fakeBotAPI) Calls(methods ...string) []botCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var calls []botCall
+	for _, call := range f.calls {
+		if len(methods) == 0 || contains(methods, call.Method) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Reset forgets the calls received so far
+func (f *fakeBotAPI) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeBotAPI) serve(res http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if path, found := strings.CutPrefix(req.URL.Path, "/file/bot"+testAPIKey+"/"); found {
+		f.calls = append(f.calls, botCall{Method: "downloadFile", Params: map[string]string{"file_path": path}})
+		for _, file := range f.files {
+			if file.path == path {
+				res.Write(file.data)
+				return
+			}
+		}
+		http.NotFound(res, req)
+		return
+	}
+
+	method, found := strings.CutPrefix(req.URL.Path, "/bot"+testAPIKey+"/")
+	if !found {
+		f.fail(res, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	call, err := readCall(method, req)
+	if err != nil {
+		f.t.Errorf("could not read %s call: %v", method, err)
+		f.fail(res, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+	f.calls = append(f.calls, call)
+
+	switch method {
+	case "getFile":
+		file, found := f.files[call.Params["file_id"]]
+		if !found {
+			f.fail(res, http.StatusBadRequest, "Bad Request: invalid file_id")
+			return
+		}
+		f.ok(res, telegramFile{FileID: call.Params["file_id"], FileUniqueID: file.uniqueID, FilePath: file.path})
+	case "sendMessage", "editMessageText":
+		f.ok(res, sentMessage{MessageID: f.messageID(call)})
+	case "sendPhoto":
+		f.ok(res, sentMessage{MessageID: f.messageID(call), Photo: f.photo(call.Params["photo"], call.Files["photo"])})
+	case "editMessageMedia":
+		var media inputMediaPhoto
+		json.Unmarshal([]byte(call.Params["media"]), &media)
+		f.ok(res, sentMessage{MessageID: f.messageID(call), Photo: f.photo(media.Media, call.Files["photo"])})
+	case "sendMediaGroup":
+		var media []inputMediaPhoto
+		json.Unmarshal([]byte(call.Params["media"]), &media)
+		sent := make([]sentMessage, len(media))
+		for i, m := range media {
+			field, _ := strings.CutPrefix(m.Media, "attach://")
+			sent[i] = sentMessage{MessageID: f.messageID(call), Photo: f.photo(m.Media, call.Files[field])}
+		}
+		f.ok(res, sent)
+	case "setWebhook", "answerCallbackQuery":
+		f.ok(res, true)
+	default:
+		f.fail(res, http.StatusNotFound, "Not Found")
+	}
+}
+
+// messageID is the ID of the edited message, or a new one for a sent message
+func (f *fakeBotAPI) messageID(call botCall) int64 {
+	if id, found := call.Params["message_id"]; found {
+		var messageID int64
+		fmt.Sscan(id, &messageID)
+		return messageID
+	}
+	f.nextMessageID++
+	return f.nextMessageID
+}
+
+// photo stores an uploaded photo, or looks up one sent by file_id
+func (f *fakeBotAPI) photo(ref string, upload []byte) []photoSize {
+	if upload != nil {
+		fileID, _ := f.addFileLocked(upload)
+		return f.photoSizes(fileID)
+	}
+	if _, found := f.files[ref]; !found {
+		f.t.Errorf("photo sent with unknown file_id %q", ref)
+	}
+	return f.photoSizes(ref)
+}
+
+func (f *fakeBotAPI) ok(res http.ResponseWriter, result any) {
+	json.NewEncoder(res).Encode(apiResponse[any]{OK: true, Result: result})
+}
+
+func (f *fakeBotAPI) fail(res http.ResponseWriter, status int, description string) {
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(apiResponse[any]{ErrorCode: status, Description: description})
+}
+
+// readCall reads the parameters of a call, sent as JSON or as a form
+func readCall(method string, req *http.Request) (botCall, error) {
+	call := botCall{Method: method, Params: make(map[string]string), Files: make(map[string][]byte)}
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		var params map[string]json.RawMessage
+		if err := json.NewDecoder(req.Body).Decode(&params); err != nil {
+			return call, err
+		}
+		for name, value := range params {
+			var s string
+			if json.Unmarshal(value, &s) == nil {
+				call.Params[name] = s
+			} else {
+				call.Params[name] = string(value)
+			}
+		}
+		return call, nil
+	}
+
+	if err := req.ParseMultipartForm(10 << 20); err != nil {
+		return call, err
+	}
+	for name, values := range req.MultipartForm.Value {
+		call.Params[name] = values[0]
+	}
+	for name, headers := range req.MultipartForm.File {
+		file, err := headers[0].Open()
+		if err != nil {
+			return call, err
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return call, err
+		}
+		call.Files[name] = data
+	}
+	return call, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Telegram keeps files around for as long as the bot exists, the TTL only stops
+// images that are never sent again from piling up in Redis
+const fileIDTTL = 30 * 24 * time.Hour
+
+// fileIDCache remembers the file_id Telegram assigned to each image we uploaded, by content hash
+type fileIDCache interface {
+	Get(ctx context.Context, hash string) (string, error)
+	Set(ctx context.Context, hash, fileID string) error
+}
+
+type redisFileIDs struct {
+	client *redis.Client
+}
+
+func fileIDKey(hash string) string {
+	return "File-" + hash
+}
+
+// Get returns the cached file_id, or "" if the image hasn't been uploaded yet
+func (c redisFileIDs) Get(ctx context.Context, hash string) (string, error) {
+	fileID, err := c.client.Get(ctx, fileIDKey(hash)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return fileID, err
+}
+
+func (c redisFileIDs) Set(ctx context.Context, hash, fileID string) error {
+	return c.client.Set(ctx, fileIDKey(hash), fileID, fileIDTTL).Err()
+}
+
+// photoSize is one of the sizes Telegram keeps of a photo
+type photoSize struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// largestPhoto returns the full size version of a photo
+func largestPhoto(sizes []photoSize) photoSize {
+	var largest photoSize
+	for _, size := range sizes {
+		if size.Width*size.Height >= largest.Width*largest.Height {
+			largest = size
+		}
+	}
+	return largest
+}
+
+// photo is an image ready to send, either by the file_id of an earlier upload of
+// the same PNG or as a new upload
+type photo struct {
+	hash   string
+	fileID string
+	data   []byte
+}
+
+// preparePhoto encodes img and looks for an earlier upload of it
+func (t *telegram) preparePhoto(ctx context.Context, img image.Image) (photo, error) {
+	data, err := encodePNG(img)
+	if err != nil {
+		return photo{}, err
+	}
+
+	sum := sha256.Sum256(data)
+	p := photo{hash: hex.EncodeToString(sum[:])}
+	if t.fileIDs != nil {
+		if p.fileID, err = t.fileIDs.Get(ctx, p.hash); err != nil {
+			loggerFrom(ctx).Warn("could not look up file_id", "hash", p.hash, "error", err)
+		}
+	}
+	if p.fileID == "" {
+		p.data = data
+	}
+	return p, nil
+}
+
+// media is how to refer to p in an InputMedia, adding it to files if it has to be uploaded
+func (p photo) media(field string, files *[]upload) string {
+	if p.fileID != "" {
+		return p.fileID
+	}
+	*files = append(*files, upload{field, field + ".png", p.data})
+	return "attach://" + field
+}
+
+// remember caches the file_id Telegram assigned to a photo we uploaded
+func (t *telegram) remember(ctx context.Context, p photo, sent sentMessage) {
+	if t.fileIDs == nil || p.fileID != "" || len(sent.Photo) == 0 {
+		return
+	}
+	if err := t.fileIDs.Set(ctx, p.hash, largestPhoto(sent.Photo).FileID); err != nil {
+		loggerFrom(ctx).Warn("could not cache file_id", "hash", p.hash, "error", err)
+	}
+}
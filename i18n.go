@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	cwmaze "dungeonbot/maze"
+	"dungeonbot/mdv2"
+)
+
+const defaultLanguage = "en"
+
+// catalog holds every user-facing string, keyed by language and then message key.
+// Messages are plain text, they are escaped for MarkdownV2 when translated.
+// Counted nouns list their plural forms separated by "|", see pluralForm.
+var catalog = map[string]map[string]string{
+	"en": {
+		"map.download_failed": "Failed to get map image from Telegram server",
+		"map.decode_failed":   "Failed to decode map image",
+		"map.save_failed":     "Failed to save map",
+		"map.summary":         "This map has %s, %s and %s. Boss located at %s.",
+		"map.fetch_failed":    "Error fetching map",
+		"map.missing":         "No map found, please forward map before sending a scribble",
+		"map.unchanged":       "This is the map you are already on, your position is kept.",
+
+		"state.no_map":      "No map found, please forward map before taking other actions",
+		"state.no_scribble": "No scribble found, please forward scribble before taking other actions",
+		"state.not_located": "Your last scribble didn't match the map, send a new scribble or set your position with /at_x_y",
+
+		"scribble.invalid":     "There seems to be a problem with your scribble",
+		"scribble.matches":     "Found %d matches: %s",
+		"scribble.found":       "Location Found!",
+		"scribble.help":        "Try these commands for more help:\n\n/path to find a path to the boss using fountains\n/path_chest for a path to the nearest chest\n/path_mob for a path to the nearest mob\n\nFor more options try /mobs or /chests",
+		"scribble.player_at":   "Player at: %s",
+		"scribble.found_many":  "Found %d locations matching scribble",
+		"scribble.save_failed": "Failed to save scribble",
+		"scribble.ambiguous":   "Scribble matches %d locations in map.  Must be 1 to %s",
+		"scribble.not_found":   "Scribble doesn't match anywhere on the map",
+		"scribble.locate":      "Send /locate with the scribble pasted on the lines below it",
+		"scribble.unknown":     "These symbols in the scribble weren't recognized, they were taken to match any tile: %s",
+		"scribble.closest":     "Closest places: %s",
+		"scribble.near":        "%s (tiles that differ: %d)",
+		"scribble.stale_map":   "If the maze changed since you forwarded the map, forward the new map and send the scribble again. The second picture shows how your scribble was read.",
+
+		"action.path":   "find path",
+		"action.mobs":   "find mobs",
+		"action.chests": "find chests",
+
+		"command.unparsed": "Could not parse command",
+		"command.unknown":  "Try forwarding a map or scribble of a dungeon",
+
+		"path.invalid_chest": "Invalid chest number: %d",
+		"path.invalid_mob":   "Invalid mob number: %d",
+		"path.no_step_path":  "No path found when counting steps, providing shortest path",
+		"path.none":          "No path found",
+		"path.summary":       "Path to %s: %s",
+
+		"count.chests":    "%d chest|%d chests",
+		"count.fountains": "%d fountain|%d fountains",
+		"count.monsters":  "%d monster|%d monsters",
+		"count.steps":     "%d step|%d steps",
+
+		"list.mob":   "%s path to mob at %s %s",
+		"list.chest": "%s path to chest at %s %s",
+
+		"location.outside":     "Position is a wall or outside of the maze.",
+		"location.save_failed": "Failed to save location",
+		"location.set":         "Location set: %s",
+
+		"settings.title":       "Settings",
+		"settings.show_failed": "Failed to show settings",
+		"settings.step_budget": "Step budget: %d",
+		"settings.list_length": "List length: %d",
+		"settings.routing":     "Routing: %s",
+		"settings.language":    "Language: %s",
+		"settings.replies":     "Replies: %s",
+		"settings.maps":        "Maps: %s",
+		"settings.list":        "List %d",
+		"settings.reset":       "Reset to defaults",
+		"route.fountains":      "Via fountains",
+		"route.shortest":       "Shortest",
+		"language.auto":        "Auto",
+		"language.en":          "English",
+		"language.ru":          "Русский",
+		"replies.all":          "Image + text",
+		"replies.image":        "Image only",
+		"replies.text":         "Text only",
+		"maps.edit":            "Update last map",
+		"maps.post":            "Post new map",
+		"error.unexpected":     "Something went wrong: %s",
+		"error.internal":       "Something went wrong, please try again later. Error ID: %s",
+	},
+	"ru": {
+		"map.download_failed": "Не удалось получить карту с сервера Telegram",
+		"map.decode_failed":   "Не удалось распознать изображение карты",
+		"map.save_failed":     "Не удалось сохранить карту",
+		"map.summary":         "На карте %s, %s и %s. Босс находится в %s.",
+		"map.fetch_failed":    "Ошибка загрузки карты",
+		"map.missing":         "Карта не найдена, перешлите карту перед отправкой каракулей",
+		"map.unchanged":       "Это та же карта, ваше местоположение сохранено.",
+
+		"state.no_map":      "Карта не найдена, перешлите карту перед другими действиями",
+		"state.no_scribble": "Каракули не найдены, перешлите каракули перед другими действиями",
+		"state.not_located": "Последние каракули не совпали с картой, отправьте новые каракули или укажите позицию через /at_x_y",
+
+		"scribble.invalid":     "Похоже, с вашими каракулями что-то не так",
+		"scribble.matches":     "Найдено совпадений: %d: %s",
+		"scribble.found":       "Местоположение найдено!",
+		"scribble.help":        "Попробуйте эти команды:\n\n/path, чтобы найти путь к боссу через фонтаны\n/path_chest — путь к ближайшему сундуку\n/path_mob — путь к ближайшему монстру\n\nДругие варианты: /mobs или /chests",
+		"scribble.player_at":   "Игрок в точке: %s",
+		"scribble.found_many":  "Каракулям соответствует мест: %d",
+		"scribble.save_failed": "Не удалось сохранить каракули",
+		"scribble.ambiguous":   "Каракулям соответствует мест на карте: %d. Чтобы %s, должно быть ровно одно",
+		"scribble.not_found":   "Каракули не совпадают ни с одним местом на карте",
+		"scribble.locate":      "Отправьте /locate и вставьте каракули на строках под ним",
+		"scribble.unknown":     "Эти символы в каракулях не распознаны, они считаются любой клеткой: %s",
+		"scribble.closest":     "Ближайшие места: %s",
+		"scribble.near":        "%s (отличий: %d)",
+		"scribble.stale_map":   "Если лабиринт изменился после пересылки карты, перешлите новую карту и отправьте каракули снова. На второй картинке показано, как были прочитаны ваши каракули.",
+
+		"action.path":   "найти путь",
+		"action.mobs":   "найти монстров",
+		"action.chests": "найти сундуки",
+
+		"command.unparsed": "Не удалось разобрать команду",
+		"command.unknown":  "Перешлите карту или каракули подземелья",
+
+		"path.invalid_chest": "Неверный номер сундука: %d",
+		"path.invalid_mob":   "Неверный номер монстра: %d",
+		"path.no_step_path":  "Путь с учётом шагов не найден, показан кратчайший путь",
+		"path.none":          "Путь не найден",
+		"path.summary":       "Путь к %s: %s",
+
+		"count.chests":    "%d сундук|%d сундука|%d сундуков",
+		"count.fountains": "%d фонтан|%d фонтана|%d фонтанов",
+		"count.monsters":  "%d монстр|%d монстра|%d монстров",
+		"count.steps":     "%d шаг|%d шага|%d шагов",
+
+		"list.mob":   "%s путь к монстру в %s %s",
+		"list.chest": "%s путь к сундуку в %s %s",
+
+		"location.outside":     "Позиция на стене или за пределами лабиринта.",
+		"location.save_failed": "Не удалось сохранить местоположение",
+		"location.set":         "Местоположение установлено: %s",
+
+		"settings.title":       "Настройки",
+		"settings.show_failed": "Не удалось показать настройки",
+		"settings.step_budget": "Запас шагов: %d",
+		"settings.list_length": "Длина списка: %d",
+		"settings.routing":     "Маршрут: %s",
+		"settings.language":    "Язык: %s",
+		"settings.replies":     "Ответы: %s",
+		"settings.maps":        "Карты: %s",
+		"settings.list":        "Список: %d",
+		"settings.reset":       "Сбросить настройки",
+		"route.fountains":      "Через фонтаны",
+		"route.shortest":       "Кратчайший",
+		"language.auto":        "Авто",
+		"language.en":          "English",
+		"language.ru":          "Русский",
+		"replies.all":          "Картинка + текст",
+		"replies.image":        "Только картинка",
+		"replies.text":         "Только текст",
+		"maps.edit":            "Обновлять последнюю",
+		"maps.post":            "Отправлять новую",
+		"error.unexpected":     "Что-то пошло не так: %s",
+		"error.internal":       "Что-то пошло не так, попробуйте позже. Код ошибки: %s",
+	},
+}
+
+// translator looks up messages in the catalog for a single language
+type translator struct {
+	lang string
+	log  *slog.Logger
+}
+
+// newTranslator picks the chat's language setting, falling back to the
+// language of the user's Telegram client
+func newTranslator(settings Settings, from *user, log *slog.Logger) translator {
+	if settings.Language != languageAuto {
+		return translator{settings.Language, log}
+	}
+	if from != nil {
+		lang := strings.ToLower(from.LanguageCode)
+		if i := strings.IndexAny(lang, "-_"); i >= 0 {
+			lang = lang[:i]
+		}
+		if _, found := catalog[lang]; found {
+			return translator{lang, log}
+		}
+	}
+	return translator{defaultLanguage, log}
+}
+
+// format looks up the message, falling back to the default language
+func (t translator) format(key string) string {
+	format, found := catalog[t.lang][key]
+	if !found {
+		format, found = catalog[defaultLanguage][key]
+	}
+	if !found {
+		t.log.Warn("missing translation", "key", key, "lang", t.lang)
+		format = key
+	}
+	return format
+}
+
+// Plain returns the translated message without any escaping
+func (t translator) Plain(key string, args ...any) string {
+	format := t.format(key)
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Count returns the translated counted noun in the plural form for n
+func (t translator) Count(key string, n int) string {
+	forms := strings.Split(t.format(key), "|")
+	return fmt.Sprintf(forms[min(pluralForm(t.lang, n), len(forms)-1)], n)
+}
+
+// pluralForm picks which of a counted noun's forms is used for n: English
+// has one and other, Russian has one, few and many
+func pluralForm(lang string, n int) int {
+	if n < 0 {
+		n = -n
+	}
+	switch lang {
+	case "ru":
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return 0
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return 1
+		default:
+			return 2
+		}
+	default:
+		if n == 1 {
+			return 0
+		}
+		return 1
+	}
+}
+
+// T returns the translated message escaped for MarkdownV2
+func (t translator) T(key string, args ...any) mdv2.Text {
+	return mdv2.Plain(t.Plain(key, args...))
+}
+
+// Markdown returns the translated message with args that are already MarkdownV2,
+// such as commands and coordinates, only the message itself is escaped
+func (t translator) Markdown(key string, args ...mdv2.Text) mdv2.Text {
+	values := make([]any, len(args))
+	for i := range args {
+		values[i] = args[i]
+	}
+	return mdv2.Text(fmt.Sprintf(mdv2.Escape(t.format(key)), values...))
+}
+
+// Bold returns the translated message escaped for MarkdownV2 and set in bold
+func (t translator) Bold(key string, args ...any) mdv2.Text {
+	return mdv2.Bold(t.T(key, args...))
+}
+
+// Error translates errors we know about, anything else is reported as is
+func (t translator) Error(err error) mdv2.Text {
+	switch {
+	case errors.Is(err, errNoMap):
+		return t.T("state.no_map")
+	case errors.Is(err, errNoScribble):
+		return t.T("state.no_scribble")
+	case errors.Is(err, errNotLocated):
+		return t.T("state.not_located")
+	case errors.Is(err, cwmaze.ErrNoStepPath):
+		return t.T("path.no_step_path")
+	case errors.Is(err, cwmaze.ErrNoPath):
+		return t.T("path.none")
+	default:
+		return t.T("error.unexpected", err)
+	}
+}
+
+// MapSummary describes a freshly loaded maze
+func (t translator) MapSummary(m cwmaze.Maze) mdv2.Text {
+	return t.T("map.summary", t.Count("count.chests", len(m.Chests)), t.Count("count.fountains", len(m.Fountains)),
+		t.Count("count.monsters", len(m.Mobs)), m.Boss)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestCatalogComplete(t *testing.T) {
+	for lang, messages := range catalog {
+		for key, format := range catalog[defaultLanguage] {
+			translated, found := messages[key]
+			if !found {
+				t.Errorf("%s: missing translation for %q", lang, key)
+				continue
+			}
+			for _, form := range strings.Split(translated, "|") {
+				if strings.Count(form, "%") != strings.Count(strings.Split(format, "|")[0], "%") {
+					t.Errorf("%s: %q has different format verbs than %s", lang, key, defaultLanguage)
+				}
+			}
+		}
+		for key := range messages {
+			if _, found := catalog[defaultLanguage][key]; !found {
+				t.Errorf("%s: %q is not in the %s catalog", lang, key, defaultLanguage)
+			}
+		}
+	}
+}
+
+func TestNewTranslator(t *testing.T) {
+	cases := []struct {
+		setting  string
+		from     *user
+		expected string
+	}{
+		{languageAuto, nil, "en"},
+		{languageAuto, &user{LanguageCode: "ru"}, "ru"},
+		{languageAuto, &user{LanguageCode: "ru-RU"}, "ru"},
+		{languageAuto, &user{LanguageCode: "de"}, "en"},
+		{"en", &user{LanguageCode: "ru"}, "en"},
+		{"ru", nil, "ru"},
+	}
+
+	for _, c := range cases {
+		settings := defaultSettings()
+		settings.Language = c.setting
+		if tr := newTranslator(settings, c.from, slog.Default()); tr.lang != c.expected {
+			t.Errorf("newTranslator(%q, %v) = %q, want %q", c.setting, c.from, tr.lang, c.expected)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	cases := []struct {
+		lang     string
+		n        int
+		expected string
+	}{
+		{"en", 0, "0 chests"},
+		{"en", 1, "1 chest"},
+		{"en", 2, "2 chests"},
+		{"ru", 1, "1 сундук"},
+		{"ru", 3, "3 сундука"},
+		{"ru", 5, "5 сундуков"},
+		{"ru", 11, "11 сундуков"},
+		{"ru", 12, "12 сундуков"},
+		{"ru", 21, "21 сундук"},
+		{"ru", 24, "24 сундука"},
+		{"ru", 111, "111 сундуков"},
+	}
+
+	for _, c := range cases {
+		if got := (translator{c.lang, slog.Default()}).Count("count.chests", c.n); got != c.expected {
+			t.Errorf("%s: Count(%d) = %q, want %q", c.lang, c.n, got, c.expected)
+		}
+	}
+}
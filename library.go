@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	cwmaze "dungeonbot/maze"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Maps are kept once in a library, by fingerprint, and every chat that forwarded a
+// map refers to it. A map that no chat loads for this long is dropped.
+const mapTTL = 30 * 24 * time.Hour
+
+// the fingerprint of a photo's map is kept by its file_unique_id, for when it's forwarded again
+const photoTTL = 7 * 24 * time.Hour
+
+func mapKey(fingerprint string) string {
+	return "Map-" + fingerprint
+}
+
+// chatMapKey holds the fingerprint of the map a chat is on
+func chatMapKey(chatID int64) string {
+	return fmt.Sprintf("%d-Map", chatID)
+}
+
+func photoKey(fileUniqueID string) string {
+	return "Photo-" + fileUniqueID
+}
+
+// saveMap adds a map to the library, if it's already there this only keeps it for longer
+func (a *App) saveMap(ctx context.Context, m *cwmaze.Maze, fingerprint string) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return a.redis.Set(ctx, mapKey(fingerprint), data, mapTTL).Err()
+}
+
+// loadMap fetches a map from the library, it returns redis.Nil if there is no such map
+func (a *App) loadMap(ctx context.Context, fingerprint string) (*cwmaze.Maze, error) {
+	data, err := a.redis.GetEx(ctx, mapKey(fingerprint), mapTTL).Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	// maps saved before the binary encoding are JSON, Decode reads both
+	m, err := cwmaze.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode map %s: %w", fingerprint, err)
+	}
+	if bytes.HasPrefix(data, []byte("{")) {
+		if err := a.saveMap(ctx, m, fingerprint); err != nil {
+			loggerFrom(ctx).Warn("could not convert map to the binary encoding", "map", fingerprint, "error", err)
+		}
+	}
+	return m, nil
+}
+
+// getChatMap returns the map the chat is on and its fingerprint, or redis.Nil if the
+// chat hasn't forwarded one
+func (a *App) getChatMap(ctx context.Context, chatID int64) (*cwmaze.Maze, string, error) {
+	fingerprint, err := a.redis.Get(ctx, chatMapKey(chatID)).Result()
+	if err == redis.Nil {
+		return a.migrateChatMap(ctx, chatID)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	m, err := a.loadMap(ctx, fingerprint)
+	if m != nil {
+		m.Log = loggerFrom(ctx)
+	}
+	return m, fingerprint, err
+}
+
+// migrateChatMap moves a map stored under the chat's ID, from before the library,
+// into the library
+func (a *App) migrateChatMap(ctx context.Context, chatID int64) (*cwmaze.Maze, string, error) {
+	m := &cwmaze.Maze{Log: loggerFrom(ctx)}
+	if err := getFromRedis(ctx, a.redis, m, fmt.Sprint(chatID)); err != nil {
+		return nil, "", err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, "", fmt.Errorf("could not migrate map of chat %d: %w", chatID, err)
+	}
+
+	fingerprint := m.Fingerprint()
+	if err := a.saveMap(ctx, m, fingerprint); err != nil {
+		return nil, "", err
+	}
+	if err := a.setChatMap(ctx, chatID, fingerprint); err != nil {
+		return nil, "", err
+	}
+	// the old key is never read again once the chat points at the library
+	a.redis.Del(ctx, fmt.Sprint(chatID))
+	return m, fingerprint, nil
+}
+
+// setChatMap points the chat at a map in the library
+func (a *App) setChatMap(ctx context.Context, chatID int64, fingerprint string) error {
+	return a.redis.Set(ctx, chatMapKey(chatID), fingerprint, 0).Err()
+}
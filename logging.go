@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// newLogger logs JSON in production and text elsewhere. The level comes from
+// LOG_LEVEL, production defaults to warnings so the logs stay quiet.
+func newLogger(env, level string) *slog.Logger {
+	var lvl slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		lvl = slog.LevelDebug
+	case "info":
+		lvl = slog.LevelInfo
+	case "warn", "warning":
+		lvl = slog.LevelWarn
+	case "error":
+		lvl = slog.LevelError
+	default:
+		if env == "production" {
+			lvl = slog.LevelWarn
+		} else {
+			lvl = slog.LevelDebug
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	if env == "production" {
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stdout, opts))
+}
+
+type loggerKey struct{}
+
+// withLogger returns a copy of ctx carrying log, for code that is handed a ctx
+// but not the logger of the update it works for
+func withLogger(ctx context.Context, log *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// loggerFrom returns the logger ctx carries, or the default logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if log, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return log
+	}
+	return slog.Default()
+}
+
+// updateLogger adds the fields identifying an update to every line
+func updateLogger(log *slog.Logger, u *update) *slog.Logger {
+	return log.With("update_id", u.UpdateID, "chat_id", u.chatID())
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewLoggerLevel(t *testing.T) {
+	cases := []struct {
+		env   string
+		level string
+		want  slog.Level
+	}{
+		{"production", "", slog.LevelWarn},
+		{"development", "", slog.LevelDebug},
+		{"production", "debug", slog.LevelDebug},
+		{"production", "INFO", slog.LevelInfo},
+		{"development", "error", slog.LevelError},
+	}
+
+	for _, c := range cases {
+		logger := newLogger(c.env, c.level)
+		if !logger.Enabled(context.Background(), c.want) || logger.Enabled(context.Background(), c.want-1) {
+			t.Errorf("newLogger(%q, %q) does not log from level %s", c.env, c.level, c.want)
+		}
+	}
+}
+
+func TestLoggerFromContext(t *testing.T) {
+	if loggerFrom(context.Background()) != slog.Default() {
+		t.Errorf("loggerFrom a bare context is not the default logger")
+	}
+
+	// a retried Telegram call logs with the fields of the update it was made for
+	var out bytes.Buffer
+	log := updateLogger(slog.New(slog.NewTextHandler(&out, nil)), &update{UpdateID: 7})
+	tg, _, _ := scriptedAPI(t,
+		`502 Bad Gateway`,
+		`200 {"ok":true,"result":{"message_id":99}}`,
+	)
+	if _, err := tg.SendMessage(withLogger(context.Background(), log), 5, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "retrying telegram call") || !strings.Contains(out.String(), "update_id=7") {
+		t.Errorf("logged %q, want the retry with the update_id", out.String())
+	}
+}
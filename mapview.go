@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// the map view is the last photo of the map with the player's position, route or
+// nearby things marked on it, which /path, /mobs and /chests update in place
+
+func mapViewKey(chatID int64) string {
+	return fmt.Sprintf("%d-MapView", chatID)
+}
+
+// getMapView returns the ID of the chat's map view message, or 0 if there is none
+func (a *App) getMapView(ctx context.Context, chatID int64, log *slog.Logger) int64 {
+	messageID, err := a.redis.Get(ctx, mapViewKey(chatID)).Int64()
+	if err != nil {
+		if err != redis.Nil {
+			log.Error("could not fetch map view", "error", err)
+		}
+		return 0
+	}
+	return messageID
+}
+
+func (a *App) saveMapView(ctx context.Context, chatID, messageID int64) error {
+	return a.redis.Set(ctx, mapViewKey(chatID), strconv.FormatInt(messageID, 10), 0).Err()
+}
+
+// forgetMapView makes the next map view a new message, for when the map changes
+func (a *App) forgetMapView(ctx context.Context, chatID int64) error {
+	return a.redis.Del(ctx, mapViewKey(chatID)).Err()
+}
@@ -0,0 +1,276 @@
+package cwmaze
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// corpusScribble is a scribble drawn where the player stands at a known place
+type corpusScribble struct {
+	file string
+	at   Point
+}
+
+// corpusMap is a screenshot of a map along with the tiles it shows, in the ASCII of
+// Maze.Text. full.tiles was read from test.jpeg, the screenshots are test.jpeg saved
+// again at a lower JPEG quality, and cropped to smaller mazes sealed with an outer
+// wall like real maps of those sizes, saved as PNG or JPEG like clients recompress
+// photos. TestCorpusGrids and TestCorpusReference check the tiles without the decoder.
+type corpusMap struct {
+	image string
+	tiles string
+	// tolerance is how many tiles may decode wrong, blurred JPEG blocks can change
+	// small tiles
+	tolerance int
+	// miscount is how far off the counts of chests, fountains and mobs may be, or
+	// -1 when the image is too blurred for them to mean anything
+	miscount int
+
+	boss                    Point
+	chests, fountains, mobs int
+	scribbles               []corpusScribble
+}
+
+var (
+	fullScribbles   = []corpusScribble{{"full-1.scribble", Point{19, 4}}, {"full-2.scribble", Point{7, 31}}}
+	mediumScribbles = []corpusScribble{{"medium-1.scribble", Point{13, 4}}, {"medium-2.scribble", Point{7, 31}}}
+	smallScribbles  = []corpusScribble{{"small-1.scribble", Point{13, 4}}, {"small-2.scribble", Point{7, 31}}}
+)
+
+var corpus = []corpusMap{
+	{image: "full-q75.jpeg", tiles: "full.tiles", tolerance: 16, miscount: -1, boss: Point{89, 80}, chests: 48, fountains: 321, mobs: 176, scribbles: fullScribbles},
+	{image: "medium.png", tiles: "medium.tiles", boss: Point{49, 40}, chests: 16, fountains: 79, mobs: 46, scribbles: mediumScribbles},
+	{image: "medium-q85.jpeg", tiles: "medium.tiles", tolerance: 1, miscount: 1, boss: Point{49, 40}, chests: 16, fountains: 79, mobs: 46, scribbles: mediumScribbles},
+	{image: "small.png", tiles: "small.tiles", boss: Point{19, 20}, chests: 3, fountains: 20, mobs: 13, scribbles: smallScribbles},
+	// mobs blur into unknown tiles at this quality, so scribbles next to them don't match
+	{image: "small-q60.jpeg", tiles: "small.tiles", tolerance: 10, miscount: -1, boss: Point{19, 20}, chests: 3, fountains: 20, mobs: 13},
+}
+
+func corpusPath(name string) string {
+	return filepath.Join("testdata", "corpus", name)
+}
+
+func loadCorpusMap(t *testing.T, name string) Maze {
+	f, err := os.Open(corpusPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	m := Maze{}
+	m.Load(img)
+	return m
+}
+
+// tileDiff lists where got and want, renderings from Maze.Text, differ
+func tileDiff(got, want string) ([]string, error) {
+	gotRows := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	wantRows := strings.Split(strings.TrimSuffix(want, "\n"), "\n")
+	if len(gotRows) != len(wantRows) {
+		return nil, fmt.Errorf("decoded %d rows, want %d", len(gotRows), len(wantRows))
+	}
+
+	var diff []string
+	for y := range wantRows {
+		if len(gotRows[y]) != len(wantRows[y]) {
+			return nil, fmt.Errorf("row %d has %d tiles, want %d", y, len(gotRows[y]), len(wantRows[y]))
+		}
+		for x := range wantRows[y] {
+			if gotRows[y][x] != wantRows[y][x] {
+				diff = append(diff, fmt.Sprintf("{%d, %d} %c want %c", x, y, gotRows[y][x], wantRows[y][x]))
+			}
+		}
+	}
+	return diff, nil
+}
+
+// TestCorpusGrids checks the expected tiles are shaped like a maze: an odd number of
+// rows and columns inside an outer wall, with a wall where an even row meets an even
+// column and a room where odd ones meet
+func TestCorpusGrids(t *testing.T) {
+	for _, name := range []string{"full.tiles", "medium.tiles", "small.tiles"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(corpusPath(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			height, width := len(rows), len(rows[0])
+			if height%2 == 0 || width%2 == 0 {
+				t.Fatalf("grid is %dx%d, want odd sizes", width, height)
+			}
+
+			for y, row := range rows {
+				if len(row) != width {
+					t.Fatalf("row %d has %d tiles, want %d", y, len(row), width)
+				}
+				for x := range row {
+					edge := x == 0 || y == 0 || x == width-1 || y == height-1
+					switch {
+					case (edge || x%2 == 0 && y%2 == 0) && row[x] != '#':
+						t.Errorf("{%d, %d} is %c, want a wall", x, y, row[x])
+					case x%2 == 1 && y%2 == 1 && row[x] == '#':
+						t.Errorf("{%d, %d} is a wall, want a room", x, y)
+					}
+				}
+			}
+		})
+	}
+}
+
+// referencePalette is the color at the center of each kind of tile in test.jpeg,
+// in the ASCII of Maze.Text
+var referencePalette = []struct {
+	tile  byte
+	color color.RGBA
+}{
+	{'#', color.RGBA{0, 0, 0, 255}},
+	{'.', color.RGBA{252, 253, 252, 255}},
+	{'f', color.RGBA{58, 60, 254, 255}},
+	{'F', color.RGBA{56, 197, 36, 255}},
+	{'C', color.RGBA{21, 224, 114, 255}},
+	{'B', color.RGBA{254, 163, 0, 255}},
+	{'M', color.RGBA{140, 120, 244, 255}},
+	{'X', color.RGBA{238, 70, 0, 255}},
+}
+
+// referenceTiles reads img without Maze.Load: each tile is whichever color of
+// referencePalette is closest to the pixel at its center
+func referenceTiles(img image.Image) string {
+	var b strings.Builder
+	for y := 0; y+5 <= img.Bounds().Max.Y; y += 5 {
+		for x := 0; x+5 <= img.Bounds().Max.X; x += 5 {
+			c := color.RGBAModel.Convert(img.At(x+2, y+2)).(color.RGBA)
+			best, bestDistance := byte('?'), -1
+			for _, p := range referencePalette {
+				dr, dg, db := int(c.R)-int(p.color.R), int(c.G)-int(p.color.G), int(c.B)-int(p.color.B)
+				if d := dr*dr + dg*dg + db*db; bestDistance < 0 || d < bestDistance {
+					best, bestDistance = p.tile, d
+				}
+			}
+			b.WriteByte(best)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// TestCorpusReference reads the source screenshot and the lossless crops with
+// referenceTiles, so the expected tiles are not only what Maze.Load made of them
+func TestCorpusReference(t *testing.T) {
+	sources := []struct{ image, tiles string }{
+		{"test.jpeg", corpusPath("full.tiles")},
+		{corpusPath("medium.png"), corpusPath("medium.tiles")},
+		{corpusPath("small.png"), corpusPath("small.tiles")},
+	}
+	for _, s := range sources {
+		t.Run(filepath.Base(s.image), func(t *testing.T) {
+			f, err := os.Open(s.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			img, _, err := image.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(s.tiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			diff, err := tileDiff(referenceTiles(img), string(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diff) > 0 {
+				t.Errorf("%d tiles differ: %s", len(diff), strings.Join(diff, ", "))
+			}
+		})
+	}
+}
+
+func TestCorpusTiles(t *testing.T) {
+	for _, c := range corpus {
+		t.Run(c.image, func(t *testing.T) {
+			m := loadCorpusMap(t, c.image)
+			want, err := os.ReadFile(corpusPath(c.tiles))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			diff, err := tileDiff(m.Text(false), string(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diff) > 0 {
+				t.Logf("%d tiles decoded wrong: %s", len(diff), strings.Join(diff, ", "))
+			}
+			if len(diff) > c.tolerance {
+				t.Errorf("%d tiles decoded wrong, tolerance is %d", len(diff), c.tolerance)
+			}
+		})
+	}
+}
+
+func TestCorpusCounts(t *testing.T) {
+	for _, c := range corpus {
+		t.Run(c.image, func(t *testing.T) {
+			m := loadCorpusMap(t, c.image)
+			if m.Boss != c.boss || m.Types[tBOSS] != 1 {
+				t.Errorf("boss at %s (%d found), want %s", m.Boss, m.Types[tBOSS], c.boss)
+			}
+			if c.miscount < 0 {
+				return
+			}
+
+			counts := []struct {
+				name      string
+				got, want int
+			}{
+				{"chests", len(m.Chests), c.chests},
+				{"fountains", len(m.Fountains), c.fountains},
+				{"mobs", len(m.Mobs), c.mobs},
+			}
+			for _, count := range counts {
+				if abs(count.got-count.want) > c.miscount {
+					t.Errorf("%d %s, want %d", count.got, count.name, count.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCorpusScribbles(t *testing.T) {
+	for _, c := range corpus {
+		m := loadCorpusMap(t, c.image)
+		for _, s := range c.scribbles {
+			t.Run(c.image+"/"+s.file, func(t *testing.T) {
+				scribble, err := os.ReadFile(corpusPath(s.file))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				found := m.SearchByScribble(strings.TrimSuffix(string(scribble), "\n"))
+				if len(found.Matches) != 1 {
+					t.Fatalf("scribble matches %v, want only %s", found.Matches, s.at)
+				}
+				at := Point{found.Matches[0].X + found.PlayerLocation.X, found.Matches[0].Y + found.PlayerLocation.Y}
+				if at != s.at {
+					t.Errorf("player at %s, want %s", at, s.at)
+				}
+			})
+		}
+	}
+}
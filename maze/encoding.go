@@ -0,0 +1,295 @@
+package cwmaze
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Mazes are encoded as:
+//
+//	magic "CWMZ", version byte
+//	width, height as uvarints
+//	tile format byte, then the tiles row by row, either
+//	  packed two to a byte, first tile in the high nibble, if every tile fits in 4 bits
+//	  run-length encoded as (tile byte, run length uvarint) pairs
+//	whichever is smaller
+//	boss as a pair of varints
+//	chests, fountains and mobs, each a uvarint count followed by pairs of varints
+//
+// Types is not stored, it is counted again from the tiles like Load does.
+const (
+	encodingMagic   = "CWMZ"
+	encodingVersion = 1
+	// no map comes close, this only stops a corrupt header from allocating gigabytes
+	maxDimension = 4096
+
+	tilesPacked    = 1
+	tilesRunLength = 2
+)
+
+var (
+	ErrNotRectangular = errors.New("maze rows are not all the same length")
+	ErrBadEncoding    = errors.New("invalid maze encoding")
+)
+
+// MarshalBinary encodes the maze in the compact format
+func (m Maze) MarshalBinary() ([]byte, error) {
+	width, height := m.Pixels.Width(), m.Pixels.Height()
+
+	buf := make([]byte, 0, 64+len(m.Chests)*4+len(m.Fountains)*4+len(m.Mobs)*4)
+	buf = append(buf, encodingMagic...)
+	buf = append(buf, encodingVersion)
+	buf = binary.AppendUvarint(buf, uint64(width))
+	buf = binary.AppendUvarint(buf, uint64(height))
+
+	for _, row := range m.Pixels {
+		if len(row) != width {
+			return nil, ErrNotRectangular
+		}
+	}
+	packed := packTiles(m.Pixels, width*height)
+	if runs := runLengthTiles(m.Pixels, len(packed)); packed == nil || runs != nil {
+		buf = append(buf, tilesRunLength)
+		buf = append(buf, runs...)
+	} else {
+		buf = append(buf, tilesPacked)
+		buf = append(buf, packed...)
+	}
+
+	buf = appendPoint(buf, m.Boss)
+	for _, points := range [][]Point{m.Chests, m.Fountains, m.Mobs} {
+		buf = binary.AppendUvarint(buf, uint64(len(points)))
+		for _, p := range points {
+			buf = appendPoint(buf, p)
+		}
+	}
+	return buf, nil
+}
+
+// packTiles packs the tiles two to a byte, or returns nil if any tile doesn't fit in 4 bits
+func packTiles(pixels [][]uint8, count int) []byte {
+	packed := make([]byte, (count+1)/2)
+	i := 0
+	for _, row := range pixels {
+		for _, tile := range row {
+			if tile > 0x0f {
+				return nil
+			}
+			if i%2 == 0 {
+				packed[i/2] = tile << 4
+			} else {
+				packed[i/2] |= tile
+			}
+			i++
+		}
+	}
+	return packed
+}
+
+// runLengthTiles encodes the tiles as runs, giving up and returning nil once that
+// takes limit bytes or more. A limit of 0 means no limit.
+func runLengthTiles(pixels [][]uint8, limit int) []byte {
+	var buf []byte
+	run, count := uint8(0), uint64(0)
+	for _, row := range pixels {
+		for _, tile := range row {
+			if count > 0 && tile == run {
+				count++
+				continue
+			}
+			if count > 0 {
+				buf = append(buf, run)
+				buf = binary.AppendUvarint(buf, count)
+				if limit > 0 && len(buf) >= limit {
+					return nil
+				}
+			}
+			run, count = tile, 1
+		}
+	}
+	if count > 0 {
+		buf = append(buf, run)
+		buf = binary.AppendUvarint(buf, count)
+	}
+	if limit > 0 && len(buf) >= limit {
+		return nil
+	}
+	return buf
+}
+
+func appendPoint(buf []byte, p Point) []byte {
+	buf = binary.AppendVarint(buf, int64(p.X))
+	return binary.AppendVarint(buf, int64(p.Y))
+}
+
+// UnmarshalBinary decodes a maze encoded by MarshalBinary
+func (m *Maze) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(encodingMagic)) {
+		return fmt.Errorf("%w: missing header", ErrBadEncoding)
+	}
+	data = data[len(encodingMagic):]
+	if len(data) == 0 || data[0] != encodingVersion {
+		return fmt.Errorf("%w: unsupported version", ErrBadEncoding)
+	}
+	d := decoder{data: data[1:]}
+
+	width, height := d.uvarint(), d.uvarint()
+	if d.err == nil && (width > maxDimension || height > maxDimension) {
+		return fmt.Errorf("%w: %dx%d is too large", ErrBadEncoding, width, height)
+	}
+
+	decoded := Maze{Types: make(map[uint8]int), Pixels: make(Grid, height)}
+	tiles := make([]uint8, width*height)
+	switch format := d.byte(); format {
+	case tilesPacked:
+		packed := d.bytes((len(tiles) + 1) / 2)
+		for i := 0; i < len(tiles) && d.err == nil; i++ {
+			tiles[i] = packed[i/2] >> 4
+			if i%2 == 1 {
+				tiles[i] = packed[i/2] & 0x0f
+			}
+		}
+	case tilesRunLength:
+		for filled := uint64(0); filled < width*height && d.err == nil; {
+			tile, count := d.byte(), d.uvarint()
+			if count == 0 || count > width*height-filled {
+				d.fail("run of %d tiles at tile %d", count, filled)
+				break
+			}
+			for i := uint64(0); i < count; i++ {
+				tiles[filled+i] = tile
+			}
+			filled += count
+		}
+	default:
+		d.fail("unknown tile format %d", format)
+	}
+	var counts [256]int
+	for _, tile := range tiles {
+		counts[tile]++
+	}
+	for tile, count := range counts {
+		if count > 0 {
+			decoded.Types[uint8(tile)] = count
+		}
+	}
+	for y := range decoded.Pixels {
+		decoded.Pixels[y] = tiles[uint64(y)*width : uint64(y+1)*width : uint64(y+1)*width]
+	}
+
+	decoded.Boss = d.point()
+	decoded.Chests = d.points()
+	decoded.Fountains = d.points()
+	decoded.Mobs = d.points()
+
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) > 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrBadEncoding, len(d.data))
+	}
+	*m = decoded
+	return nil
+}
+
+// Decode reads a maze in either the compact format or JSON, which mazes were
+// stored as before MarshalBinary, and validates it
+func Decode(data []byte) (*Maze, error) {
+	m := &Maze{}
+	if bytes.HasPrefix(data, []byte("{")) {
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, err
+		}
+	} else if err := m.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// decoder reads values from data until the first error, which it keeps in err
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrBadEncoding, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *decoder) byte() uint8 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) == 0 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) < n {
+		d.fail("unexpected end of data")
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(v)
+}
+
+func (d *decoder) point() Point {
+	return Point{d.varint(), d.varint()}
+}
+
+func (d *decoder) points() []Point {
+	count := d.uvarint()
+	// every point takes at least two bytes
+	if count > uint64(len(d.data)/2) {
+		d.fail("%d points in %d bytes", count, len(d.data))
+		return nil
+	}
+	var points []Point
+	for i := uint64(0); i < count; i++ {
+		points = append(points, d.point())
+	}
+	return points
+}
@@ -0,0 +1,136 @@
+package cwmaze
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	m := setup()
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&m, decoded) {
+		t.Fatalf("decoded maze differs from the original")
+	}
+
+	jsonData, _ := json.Marshal(m)
+	t.Logf("binary %d bytes, JSON %d bytes", len(data), len(jsonData))
+	if len(data) >= len(jsonData)/2 {
+		t.Errorf("binary encoding is %d bytes, not much smaller than JSON at %d", len(data), len(jsonData))
+	}
+}
+
+func TestBinaryTileFormats(t *testing.T) {
+	cases := map[string]struct {
+		maze   Maze
+		format byte
+	}{
+		"alternating": {Maze{Pixels: [][]uint8{{tBOSS, 1, 0, 1, 0}, {1, 0, 1, 0, 1}}}, tilesPacked},
+		"long runs":   {Maze{Pixels: [][]uint8{{tBOSS, 1, 1, 1, 1, 1}, {1, 1, 1, 1, 1, 1}}}, tilesRunLength},
+		"wide tiles":  {Maze{Pixels: [][]uint8{{tBOSS, 200}, {3, 0}}}, tilesRunLength},
+	}
+
+	for name, c := range cases {
+		data, err := c.maze.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// magic, version, width and height
+		if format := data[len(encodingMagic)+3]; format != c.format {
+			t.Errorf("%s: tile format %d, want %d", name, format, c.format)
+		}
+
+		decoded, err := Decode(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(c.maze.Pixels, decoded.Pixels) {
+			t.Errorf("%s: decoded %v, want %v", name, decoded.Pixels, c.maze.Pixels)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	m := Maze{
+		Pixels: [][]uint8{{tWALL, tPATH}, {tBOSS, tCHEST}},
+		Types:  map[uint8]int{tWALL: 1, tPATH: 1, tBOSS: 1, tCHEST: 1},
+		Boss:   Point{0, 1},
+		Chests: []Point{{1, 1}},
+	}
+	data, _ := json.Marshal(m)
+
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&m, decoded) {
+		t.Fatalf("Decode(JSON) = %+v, want %+v", decoded, m)
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	m := Maze{Pixels: [][]uint8{{tWALL, tPATH, tPATH}, {tBOSS, tMONSTER, tWALL}}, Boss: Point{0, 1}, Mobs: []Point{{1, 1}}}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every truncation fails cleanly
+	for i := range data {
+		if _, err := Decode(data[:i]); !errors.Is(err, ErrBadEncoding) {
+			t.Errorf("Decode(%d of %d bytes) = %v, want ErrBadEncoding", i, len(data), err)
+		}
+	}
+	if _, err := Decode(append(data, 0)); !errors.Is(err, ErrBadEncoding) {
+		t.Errorf("Decode with trailing data = %v, want ErrBadEncoding", err)
+	}
+
+	if _, err := (Maze{Pixels: [][]uint8{{1, 1}, {1}}}).MarshalBinary(); !errors.Is(err, ErrNotRectangular) {
+		t.Errorf("MarshalBinary of a ragged maze = %v, want ErrNotRectangular", err)
+	}
+}
+
+func BenchmarkMarshalJSON(b *testing.B) {
+	m := setup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		json.Marshal(m)
+	}
+}
+
+func BenchmarkUnmarshalJSON(b *testing.B) {
+	m := setup()
+	data, _ := json.Marshal(m)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		json.Unmarshal(data, &Maze{})
+	}
+}
+
+func BenchmarkMarshalBinary(b *testing.B) {
+	m := setup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.MarshalBinary()
+	}
+}
+
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	m := setup()
+	data, _ := m.MarshalBinary()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		(&Maze{}).UnmarshalBinary(data)
+	}
+}
@@ -0,0 +1,158 @@
+package cwmaze
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// fuzzMaze builds a maze from fuzzer input, at most 16 tiles wide and 256 tiles in all
+func fuzzMaze(width uint8, tiles []byte) Maze {
+	if len(tiles) > 256 {
+		tiles = tiles[:256]
+	}
+	w := int(width)%16 + 1
+
+	m := Maze{Types: make(map[uint8]int)}
+	for y := 0; y < len(tiles)/w; y++ {
+		row := make([]uint8, w)
+		for x := range row {
+			row[x] = tiles[y*w+x] % (tBOSS + 1)
+			here := Point{x, y}
+			switch row[x] {
+			case tBOSS:
+				m.Boss = here
+			case tCHEST:
+				m.Chests = append(m.Chests, here)
+			case tFOUNTAIN:
+				m.Fountains = append(m.Fountains, here)
+			case tMONSTER:
+				m.Mobs = append(m.Mobs, here)
+			}
+			m.Types[row[x]]++
+		}
+		m.Pixels = append(m.Pixels, row)
+	}
+	return m
+}
+
+// checkPath fails unless path walks from to back to from, a tile at a time and only
+// across tiles that aren't walls. from is where the player is, which may be anywhere.
+func checkPath(t *testing.T, m Maze, path []Point, from, to Point) {
+	t.Helper()
+	if len(path) == 0 {
+		return
+	}
+	if path[0] != to || path[len(path)-1] != from {
+		t.Fatalf("path %v goes from %s to %s, want %s to %s", path, path[len(path)-1], path[0], from, to)
+	}
+	for i, p := range path[:len(path)-1] {
+		if !m.Pixels.InBounds(p) || m.Pixels[p.Y][p.X] == tWALL {
+			t.Fatalf("path %v crosses %s, which is a wall or outside the map", path, p)
+		}
+		if heuristic(p, path[i+1]) != 1 {
+			t.Fatalf("path %v jumps from %s to %s", path, p, path[i+1])
+		}
+	}
+}
+
+func FuzzParseScribble(f *testing.F) {
+	f.Add("")
+	f.Add("\n\n")
+	f.Add("⬛⬜⬛\n⬜🟨⬜\n⬛🟩⬛")
+	f.Add("⬛️⬜️\n🟪🟧🟦❓")
+	f.Fuzz(func(t *testing.T, scribble string) {
+		s := parseScribble(scribble, discardLogger)
+		if rows := strings.Count(scribble, "\n") + 1; len(s.Points) != rows {
+			t.Fatalf("parsed %d rows, want %d", len(s.Points), rows)
+		}
+		for y, row := range s.Points {
+			if len(row) > utf8.RuneCountInString(scribble) {
+				t.Fatalf("row %d has %d tiles, more than the scribble has runes", y, len(row))
+			}
+		}
+		if strings.ContainsRune(scribble, '\U0001f7e8') {
+			p := s.PlayerLocation
+			if p.Y >= len(s.Points) || p.X >= len(s.Points[p.Y]) || s.Points[p.Y][p.X] != 254 {
+				t.Fatalf("player at %s is not on the player's tile", p)
+			}
+		}
+	})
+}
+
+func FuzzSearchByScribble(f *testing.F) {
+	f.Add(uint8(4), []byte{0, 1, 0, 1, 1, 1, 1, 0, 0, 3, 1, 0}, "⬜⬜\n🟨⬛")
+	f.Add(uint8(2), []byte{0, 1, 6, 1}, "")
+	f.Add(uint8(3), []byte{1, 1, 1, 1, 1, 1}, "⬜\n⬜⬜⬜⬜")
+	f.Add(uint8(0), []byte{}, "🟨")
+	f.Fuzz(func(t *testing.T, width uint8, tiles []byte, scribble string) {
+		m := fuzzMaze(width, tiles)
+		s := m.SearchByScribble(scribble)
+
+		for _, match := range s.Matches {
+			for sy, row := range s.Points {
+				for sx, want := range row {
+					p := Point{match.X + sx, match.Y + sy}
+					if !m.Pixels.InBounds(p) {
+						t.Fatalf("match at %s puts the scribble outside the map", match)
+					}
+					got := m.Pixels[p.Y][p.X]
+					switch {
+					case want == 255, want == got:
+					case want == 254 && got != tWALL:
+					case want == tFOUNTAIN && got == tCHEST:
+					default:
+						t.Fatalf("match at %s has %d at %s, the scribble has %d", match, got, p, want)
+					}
+				}
+			}
+		}
+	})
+}
+
+func FuzzFindPath(f *testing.F) {
+	f.Add(uint8(4), []byte{1, 1, 1, 1, 0, 0, 3, 1, 1, 1, 1, 7}, 0, 0, 3, 2, 2)
+	f.Add(uint8(2), []byte{1, 0, 0, 1}, 0, 0, 1, 1, 5)
+	f.Add(uint8(3), []byte{3, 3, 3, 3, 1, 3, 3, 3, 3}, 1, 1, 1, 1, 0)
+	f.Add(uint8(1), []byte{1}, -5, 40, 0, 0, 35)
+	f.Fuzz(func(t *testing.T, width uint8, tiles []byte, fromX, fromY, toX, toY, steps int) {
+		m := fuzzMaze(width, tiles)
+		from, to := Point{fromX, fromY}, Point{toX, toY}
+
+		path, err := m.ShortestPath(&from, &to)
+		if (err == nil) != (len(path) > 0) {
+			t.Fatalf("ShortestPath returned %v with error %v", path, err)
+		}
+		checkPath(t, m, path, from, to)
+
+		path, err = m.FindPathWithSteps(&from, &to, steps%64)
+		if errors.Is(err, ErrNoPath) != (len(path) == 0) {
+			t.Fatalf("FindPathWithSteps returned %v with error %v", path, err)
+		}
+		checkPath(t, m, path, from, to)
+	})
+}
+
+func FuzzNearest(f *testing.F) {
+	f.Add([]byte{5, 5, 1, 1, 3, 3}, 0, 0, 2)
+	f.Add([]byte{1, 1}, 1, 1, 5)
+	f.Add([]byte{}, 0, 0, -1)
+	f.Fuzz(func(t *testing.T, coords []byte, x, y, count int) {
+		var things []Point
+		for i := 0; i+1 < len(coords); i += 2 {
+			things = append(things, Point{int(coords[i]), int(coords[i+1])})
+		}
+		location := Point{x, y}
+
+		nearest := Maze{}.Nearest(things, &location, count)
+		if len(nearest) > len(things) || len(nearest) > max(count, 0) {
+			t.Fatalf("Nearest returned %d of %d things, asked for %d", len(nearest), len(things), count)
+		}
+		for i := 1; i < len(nearest); i++ {
+			if heuristic(location, nearest[i]) < heuristic(location, nearest[i-1]) {
+				t.Fatalf("Nearest returned %v, which is not nearest first", nearest)
+			}
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package cwmaze
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// tiles only found in scribbles
+const (
+	// tPLAYER is where the player stands, over a tile that can be anything but a wall
+	tPLAYER = 254
+	// tANY is a glyph that wasn't recognized, it matches any tile
+	tANY = 255
+)
+
+// scribbleGlyphs are the squares Chat Wars draws scribbles with, by the tile they
+// stand for. Chests used to be drawn like fountains, so fountains still match chests.
+var scribbleGlyphs = map[rune]uint8{
+	'\u2b1b':     tWALL,     // ⬛
+	'\u2b1c':     tPATH,     // ⬜
+	'\U0001f7e6': tFAMOUS,   // 🟦
+	'\U0001f7e9': tFOUNTAIN, // 🟩
+	'\U0001f7eb': tCHEST,    // 🟫
+	'\U0001f7e7': tBONFIRE,  // 🟧
+	'\U0001f7ea': tMONSTER,  // 🟪
+	'\U0001f7e5': tBOSS,     // 🟥
+	'\U0001f7e8': tPLAYER,   // 🟨
+}
+
+// ignoredInScribble reports whether r changes how a glyph looks without being a
+// tile, or is space pasted between glyphs
+func ignoredInScribble(r rune) bool {
+	return unicode.In(r, unicode.Variation_Selector) || r == '\u200d' || unicode.IsSpace(r)
+}
+
+// unknownGlyphs holds the glyphs already logged, so each is only logged once
+var unknownGlyphs sync.Map
+
+// logUnknownGlyph logs a glyph the first time it turns up in a scribble, a new one
+// most likely means the game changed how it draws scribbles
+func logUnknownGlyph(r rune, log *slog.Logger) {
+	if _, seen := unknownGlyphs.LoadOrStore(r, struct{}{}); !seen {
+		log.Warn("unknown scribble glyph", "glyph", string(r), "code", fmt.Sprintf("%U", r))
+	}
+}
+
+// minScribbleGlyphs is how many known glyphs a line needs to be part of a scribble
+const minScribbleGlyphs = 3
+
+// isScribbleLine reports whether a line of text looks like a row of a scribble: at
+// least a few known glyphs, and mostly known glyphs, so a row with a new glyph in
+// it is still found
+func isScribbleLine(line string) bool {
+	known, total := 0, 0
+	for _, r := range line {
+		if ignoredInScribble(r) {
+			continue
+		}
+		total++
+		if _, found := scribbleGlyphs[r]; found {
+			known++
+		}
+	}
+	return known >= minScribbleGlyphs && known*3 >= total*2
+}
+
+// FindScribble finds the grid of a scribble anywhere in text, such as a message
+// forwarded from the game in any language or a grid pasted on its own. It returns
+// the longest run of lines that look like scribble rows, with the space between
+// glyphs taken out, or "" if there is none with at least minRows rows.
+func FindScribble(text string, minRows int) string {
+	lines := strings.Split(text, "\n")
+	var best []string
+	for start := 0; start < len(lines); start++ {
+		end := start
+		for end < len(lines) && isScribbleLine(lines[end]) {
+			end++
+		}
+		if end-start > len(best) {
+			best = lines[start:end]
+		}
+		start = end
+	}
+	if len(best) == 0 || len(best) < minRows {
+		return ""
+	}
+
+	rows := make([]string, len(best))
+	for i, line := range best {
+		rows[i] = strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, line)
+	}
+	return strings.Join(rows, "\n")
+}
@@ -0,0 +1,101 @@
+package cwmaze
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrEmptyMaze    = errors.New("maze has no tiles")
+	ErrInvalidPoint = errors.New("maze point is invalid")
+	ErrBossCount    = errors.New("maze must have exactly one boss")
+)
+
+// Grid holds the tiles of a maze by row, Validate checks that all rows have the same length
+type Grid [][]uint8
+
+// Height is the number of rows
+func (g Grid) Height() int {
+	return len(g)
+}
+
+// Width is the length of the first row, or 0 if there are no rows
+func (g Grid) Width() int {
+	if len(g) == 0 {
+		return 0
+	}
+	return len(g[0])
+}
+
+// InBounds reports whether p is a tile of the grid
+func (g Grid) InBounds(p Point) bool {
+	return p.Y >= 0 && p.Y < len(g) && p.X >= 0 && p.X < len(g[p.Y])
+}
+
+// Get returns the tile at p, and false if p is outside the grid
+func (g Grid) Get(p Point) (uint8, bool) {
+	if !g.InBounds(p) {
+		return 0, false
+	}
+	return g[p.Y][p.X], true
+}
+
+// Walkable reports whether p is a tile of the grid that isn't a wall
+func (g Grid) Walkable(p Point) bool {
+	tile, found := g.Get(p)
+	return found && tile != tWALL
+}
+
+// validate checks that the grid has tiles and that every row is as wide as the first
+func (g Grid) validate() error {
+	if g.Width() == 0 {
+		return ErrEmptyMaze
+	}
+	for y, row := range g {
+		if len(row) != g.Width() {
+			return fmt.Errorf("%w: row %d has %d tiles, want %d", ErrNotRectangular, y, len(row), g.Width())
+		}
+	}
+	return nil
+}
+
+// Validate checks that the maze is rectangular, that it has exactly one boss tile
+// and that the boss, chests, fountains and mobs are on tiles of their type. Mazes from Load and Decode are only safe to
+// use once they pass.
+func (m Maze) Validate() error {
+	if err := m.Pixels.validate(); err != nil {
+		return err
+	}
+
+	bosses := 0
+	for _, row := range m.Pixels {
+		for _, tile := range row {
+			if tile == tBOSS {
+				bosses++
+			}
+		}
+	}
+	if bosses != 1 {
+		return fmt.Errorf("%w, found %d", ErrBossCount, bosses)
+	}
+	if tile, _ := m.Pixels.Get(m.Boss); tile != tBOSS {
+		return fmt.Errorf("%w: boss at %s is not on a boss tile", ErrInvalidPoint, m.Boss)
+	}
+	lists := []struct {
+		name   string
+		tile   uint8
+		points []Point
+	}{
+		{"chest", tCHEST, m.Chests},
+		{"fountain", tFOUNTAIN, m.Fountains},
+		{"mob", tMONSTER, m.Mobs},
+	}
+	for _, list := range lists {
+		for _, p := range list.points {
+			if tile, found := m.Pixels.Get(p); !found || tile != list.tile {
+				return fmt.Errorf("%w: %s at %s is not on a %s tile", ErrInvalidPoint, list.name, p, list.name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package cwmaze
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestGrid(t *testing.T) {
+	g := Grid{{tWALL, tPATH, tCHEST}, {tPATH, tPATH, tWALL}}
+	if g.Width() != 3 || g.Height() != 2 {
+		t.Errorf("grid is %dx%d, want 3x2", g.Width(), g.Height())
+	}
+
+	cases := []struct {
+		p     Point
+		tile  uint8
+		found bool
+	}{
+		{Point{0, 0}, tWALL, true},
+		{Point{2, 0}, tCHEST, true},
+		{Point{1, 1}, tPATH, true},
+		{Point{3, 0}, 0, false},
+		{Point{0, 2}, 0, false},
+		{Point{-1, 1}, 0, false},
+		{Point{1, -1}, 0, false},
+	}
+	for _, c := range cases {
+		if g.InBounds(c.p) != c.found {
+			t.Errorf("InBounds(%s) = %v, want %v", c.p, !c.found, c.found)
+		}
+		if tile, found := g.Get(c.p); tile != c.tile || found != c.found {
+			t.Errorf("Get(%s) = %d, %v, want %d, %v", c.p, tile, found, c.tile, c.found)
+		}
+		if walkable := c.found && c.tile != tWALL; g.Walkable(c.p) != walkable {
+			t.Errorf("Walkable(%s) = %v, want %v", c.p, !walkable, walkable)
+		}
+	}
+
+	if empty := (Grid{}); empty.Width() != 0 || empty.InBounds(Point{0, 0}) {
+		t.Errorf("empty grid has tiles")
+	}
+}
+
+func TestRectangularBounds(t *testing.T) {
+	m := Maze{Pixels: Grid{{tPATH, tPATH, tPATH, tPATH}, {tWALL, tWALL, tWALL, tWALL}}}
+	if got, want := m.Bounds(), image.Rect(0, 0, 20, 10); got != want {
+		t.Errorf("Bounds() = %v, want %v", got, want)
+	}
+}
+
+func TestLoadPartialTiles(t *testing.T) {
+	m := Maze{}
+	m.Load(image.NewRGBA(image.Rect(0, 0, 12, 7)))
+	if m.Pixels.Width() != 2 || m.Pixels.Height() != 1 {
+		t.Errorf("12x7 image loaded as %dx%d tiles, want 2x1", m.Pixels.Width(), m.Pixels.Height())
+	}
+
+	m.Load(image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	if err := m.Validate(); !errors.Is(err, ErrEmptyMaze) {
+		t.Errorf("Validate() = %v for an image smaller than a tile, want ErrEmptyMaze", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := setup().Validate(); err != nil {
+		t.Fatalf("test map: %v", err)
+	}
+
+	valid := func() Maze {
+		return Maze{
+			Pixels:    Grid{{tBOSS, tCHEST}, {tFOUNTAIN, tMONSTER}},
+			Types:     map[uint8]int{tBOSS: 1, tCHEST: 1, tFOUNTAIN: 1, tMONSTER: 1},
+			Chests:    []Point{{1, 0}},
+			Fountains: []Point{{0, 1}},
+			Mobs:      []Point{{1, 1}},
+		}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("valid maze: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		corrupt func(m *Maze)
+		want    error
+	}{
+		{"empty", func(m *Maze) { m.Pixels = nil }, ErrEmptyMaze},
+		{"ragged", func(m *Maze) { m.Pixels[1] = m.Pixels[1][:1] }, ErrNotRectangular},
+		{"boss elsewhere", func(m *Maze) { m.Boss = Point{1, 1} }, ErrInvalidPoint},
+		{"no boss", func(m *Maze) { m.Pixels[0][0] = tPATH }, ErrBossCount},
+		{"two bosses", func(m *Maze) { m.Pixels[1][0], m.Fountains = tBOSS, nil }, ErrBossCount},
+		{"chest outside", func(m *Maze) { m.Chests[0] = Point{2, 0} }, ErrInvalidPoint},
+		{"fountain on a mob", func(m *Maze) { m.Fountains = append(m.Fountains, Point{1, 1}) }, ErrInvalidPoint},
+		{"mob above", func(m *Maze) { m.Mobs[0] = Point{1, -1} }, ErrInvalidPoint},
+	}
+	for _, c := range cases {
+		m := valid()
+		c.corrupt(&m)
+		if err := m.Validate(); !errors.Is(err, c.want) {
+			t.Errorf("%s: Validate() = %v, want %v", c.name, err, c.want)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package cwmaze
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"io"
+	"log/slog"
 	"math"
+	"slices"
 	"sort"
 	"strings"
-	"unicode"
 
 	pqueue "github.com/nu7hatch/gopqueue"
 )
@@ -25,17 +30,32 @@ const (
 	tTEST     = 10
 )
 
+// discardLogger is used when the caller doesn't give the maze a logger
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
 // Represents a Maze, call Load with an image to initialize
 type Maze struct {
-	Pixels    [][]uint8     `json:"pixels"`
+	Pixels    Grid          `json:"pixels"`
 	Types     map[uint8]int `json:"types"`
 	Boss      Point         `json:"boss"`
 	Chests    []Point       `json:"chests"`
 	Fountains []Point       `json:"fountains"`
 	Mobs      []Point       `json:"mobs"`
+
+	// Log is where the maze logs what it is doing, set by the caller so the lines
+	// carry its context. Nothing is logged if it is nil.
+	Log *slog.Logger `json:"-"`
+}
+
+// logger returns the maze's logger, or one that discards everything
+func (m Maze) logger() *slog.Logger {
+	if m.Log == nil {
+		return discardLogger
+	}
+	return m.Log
 }
 
-func detectPixelType(img image.Image, rect image.Rectangle) uint8 {
+func detectPixelType(img image.Image, rect image.Rectangle, log *slog.Logger) uint8 {
 	red, green, blue := 0.0, 0.0, 0.0
 	for y := rect.Bounds().Min.Y; y < rect.Bounds().Max.Y; y++ {
 		for x := rect.Bounds().Min.X; x < rect.Bounds().Max.X; x++ {
@@ -74,19 +94,20 @@ func detectPixelType(img image.Image, rect image.Rectangle) uint8 {
 			return tFAMOUS
 		}
 	} else {
-		fmt.Println("Unknown color combination: ", red, green, blue)
+		log.Warn("unknown color combination", "red", red, "green", green, "blue", blue)
 		return 9
 	}
 }
 
-// Initialize a Maze, image should come from Chat Wars
+// Initialize a Maze, image should come from Chat Wars. Tiles are 5 pixels square,
+// a partial tile at the right or bottom edge is left out.
 func (m *Maze) Load(img image.Image) {
 	m.Types = make(map[uint8]int)
-	m.Pixels = make([][]uint8, img.Bounds().Max.Y/5)
-	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y += 5 {
+	m.Pixels = make(Grid, img.Bounds().Max.Y/5)
+	for y := 0; y+5 <= img.Bounds().Max.Y; y += 5 {
 		m.Pixels[y/5] = make([]uint8, img.Bounds().Max.X/5)
-		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x += 5 {
-			p := detectPixelType(img, image.Rect(x+1, y+1, x+4, y+4))
+		for x := 0; x+5 <= img.Bounds().Max.X; x += 5 {
+			p := detectPixelType(img, image.Rect(x+1, y+1, x+4, y+4), m.logger())
 			here := Point{x / 5, y / 5}
 			switch p {
 			case tBOSS:
@@ -105,45 +126,78 @@ func (m *Maze) Load(img image.Image) {
 }
 
 func (m Maze) SearchByScribble(scribble string) Scribble {
-	state := parseScribble(scribble)
+	state := parseScribble(scribble, m.logger())
+	if state.width() == 0 {
+		return state
+	}
 
-	for y := range m.Pixels {
-		if y+len(state.Points) > len(m.Pixels) {
-			break
-		}
-		for x := range m.Pixels[y] {
-			if x+len(state.Points[0]) > len(m.Pixels[y]) {
-				break
+	for y := 0; y+len(state.Points) <= m.Pixels.Height(); y++ {
+		for x := 0; x+state.width() <= m.Pixels.Width(); x++ {
+			if m.mismatches(state, x, y, 1) == 0 {
+				state.Matches = append(state.Matches, Point{x, y})
 			}
+		}
+	}
 
-			// start with match = true, bail if we find a mismatch
-			match := true
-			for sy := range state.Points {
-				//fmt.Printf("Checking {%d, %d}\n", x, y)
-				for sx := range state.Points[sy] {
-					//fmt.Printf("{%d, %d} %d == %d\n", x+sx, y+sy, m.Pixels[y+sy][x+sx], state.scribble[sy][sx])
-					if state.Points[sy][sx] != 255 &&
-						state.Points[sy][sx] != m.Pixels[y+sy][x+sx] {
-
-						// player location matches anything but wall
-						// fountain and chest look the same in a scribble
-						if !((state.Points[sy][sx] == 254 && m.Pixels[y+sy][x+sx] != tWALL) ||
-							(state.Points[sy][sx] == tFOUNTAIN && m.Pixels[y+sy][x+sx] == tCHEST)) {
-							match = false
-							break
-						}
-
-					}
-				}
+	return state
+}
+
+// NearMatch is a place where a scribble almost matches the map
+type NearMatch struct {
+	// At is the top left of the scribble, like Scribble.Matches
+	At         Point `json:"at"`
+	Mismatches int   `json:"mismatches"`
+}
+
+// NearMatches returns the count places where the scribble differs from the map in
+// the fewest tiles, to show where the player might be when it matches nowhere
+func (m Maze) NearMatches(s Scribble, count int) []NearMatch {
+	if s.width() == 0 {
+		return nil
+	}
+
+	var near []NearMatch
+	for y := 0; y+len(s.Points) <= m.Pixels.Height(); y++ {
+		for x := 0; x+s.width() <= m.Pixels.Width(); x++ {
+			limit := math.MaxInt
+			if len(near) >= count && count > 0 {
+				// no need to count past the worst place that is kept
+				limit = near[len(near)-1].Mismatches
+			}
+			if mismatches := m.mismatches(s, x, y, limit); mismatches < limit {
+				near = append(near, NearMatch{Point{x, y}, mismatches})
+				sort.SliceStable(near, func(i, j int) bool { return near[i].Mismatches < near[j].Mismatches })
+				near = near[:min(len(near), max(count, 0))]
 			}
+		}
+	}
+	return near
+}
 
-			if match {
-				state.Matches = append(state.Matches, Point{x, y})
+// mismatches counts the tiles of the scribble, placed with its top left at {x, y},
+// that differ from the map, it stops counting at limit
+func (m Maze) mismatches(s Scribble, x, y, limit int) int {
+	count := 0
+	for sy, row := range s.Points {
+		for sx, want := range row {
+			got, found := m.Pixels.Get(Point{x + sx, y + sy})
+			if !found || !scribbleTileMatches(want, got) {
+				count++
+				if count >= limit {
+					return count
+				}
 			}
 		}
 	}
+	return count
+}
 
-	return state
+// scribbleTileMatches reports whether a scribble tile can stand for a map tile. Unknown
+// tiles match anything, the player anything but a wall, and chests look like fountains.
+func scribbleTileMatches(want, got uint8) bool {
+	return want == tANY || want == got ||
+		(want == tPLAYER && got != tWALL) ||
+		(want == tFOUNTAIN && got == tCHEST)
 }
 
 // returns list of points that can be travelled to from the specified point
@@ -156,10 +210,7 @@ func (m Maze) neighbors(p Point) (ret []Point) {
 	}
 
 	for _, p := range possible {
-		if p.X == -1 || p.Y == -1 {
-			continue
-		}
-		if m.Pixels[p.Y][p.X] != tWALL {
+		if m.Pixels.Walkable(p) {
 			ret = append(ret, p)
 		}
 	}
@@ -195,6 +246,10 @@ func travelCost(p uint8) int {
 
 // Simple A* search for best path from start to end
 func (m Maze) searchPathAStar(start, end Point) []Point {
+	if start == end {
+		return []Point{start}
+	}
+
 	startItem := Item{
 		start,
 		0,
@@ -260,6 +315,15 @@ func filter[T any](ss []T, test func(T) bool) (ret []T) {
 	return
 }
 
+// joinPath appends a path starting where the other one ends, without repeating the
+// point they share
+func joinPath(path, next []Point) []Point {
+	if len(path) > 0 && len(next) > 0 && path[len(path)-1] == next[0] {
+		next = next[1:]
+	}
+	return append(path, next...)
+}
+
 type searchState struct {
 	end     Point
 	path    []Point
@@ -301,14 +365,14 @@ func (m Maze) searchPathWithSteps(start, end Point, steps int) (final []Point) {
 		//fmt.Println(filteredList)
 
 		const PATHS_TO_TRY = 20
-		paths := make([]fullPath, PATHS_TO_TRY)
+		paths := make([]fullPath, min(PATHS_TO_TRY, len(filteredList)))
 
-		for i := 0; i < PATHS_TO_TRY; i++ {
-			paths[i].a = m.searchPathAStar(state.end, filteredList[i].location)
+		for i := range paths {
+			paths[i].a = m.searchPathAStar(filteredList[i].location, state.end)
 			paths[i].b = m.searchPathAStar(start, filteredList[i].location)
 		}
 
-		for i := 0; i < PATHS_TO_TRY; i++ {
+		for i := range paths {
 			//fmt.Println("Path from: ", state.end, " to: ", filteredList[i].location)
 			//fmt.Println("fountain: ", filteredList[i].location, "len a: ", len(paths[i].a), " len b: ", len(paths[i].b))
 
@@ -318,11 +382,11 @@ func (m Maze) searchPathWithSteps(start, end Point, steps int) (final []Point) {
 			}
 
 			if len(paths[i].b) <= steps {
-				fmt.Println("winner")
+				m.logger().Debug("found path to start", "length", len(state.path)+len(paths[i].a)+len(paths[i].b))
 				solution := make([]Point, 0, len(state.path)+len(paths[i].a)+len(paths[i].b))
 				solution = append(solution, state.path...)
-				solution = append(solution, paths[i].a...)
-				solution = append(solution, paths[i].b...)
+				solution = joinPath(solution, paths[i].a)
+				solution = joinPath(solution, paths[i].b)
 				solutions = append(solutions, solution)
 			} else {
 				state.visited[filteredList[i].location] = struct{}{}
@@ -333,7 +397,7 @@ func (m Maze) searchPathWithSteps(start, end Point, steps int) (final []Point) {
 				//fmt.Println(best.a[0], filteredList[i])]
 				tmp := make([]Point, 0, len(state.path)+len(paths[i].a))
 				tmp = append(tmp, state.path...)
-				tmp = append(tmp, paths[i].a...)
+				tmp = joinPath(tmp, paths[i].a)
 				stack = append(stack, searchState{
 					filteredList[i].location,
 					tmp,
@@ -343,12 +407,11 @@ func (m Maze) searchPathWithSteps(start, end Point, steps int) (final []Point) {
 
 		}
 	}
-	fmt.Println("Solutions: ", len(solutions))
+	m.logger().Debug("searched path with steps", "start", start, "end", end, "steps", steps, "solutions", len(solutions))
 	if len(solutions) >= 1 {
 		var bestPath []Point
 		shortest := 1000
 		for _, path := range solutions {
-			fmt.Println(len(path))
 			if len(path) < shortest {
 				shortest = len(path)
 				bestPath = path
@@ -360,11 +423,37 @@ func (m Maze) searchPathWithSteps(start, end Point, steps int) (final []Point) {
 	return make([]Point, 0)
 }
 
+// DefaultSteps is how far a player can walk between fountains
+const DefaultSteps = 35
+
+var (
+	ErrNoPath     = errors.New("no path found")
+	ErrNoStepPath = errors.New("no path found when counting steps, providing shortest path")
+)
+
 func (m Maze) FindPath(from, to *Point) ([]Point, error) {
-	value := m.searchPathWithSteps(*from, *to, 35)
+	return m.FindPathWithSteps(from, to, DefaultSteps)
+}
+
+// FindPathWithSteps finds a path that visits a fountain at least every <steps> steps,
+// falling back to the shortest path if there is none, ErrNoPath means neither exists
+func (m Maze) FindPathWithSteps(from, to *Point, steps int) ([]Point, error) {
+	value := m.searchPathWithSteps(*from, *to, steps)
 	if len(value) == 0 {
 		value = m.searchPathAStar(*from, *to)
-		return value, errors.New("no path found when counting steps, providing shortest path")
+		if len(value) == 0 {
+			return value, ErrNoPath
+		}
+		return value, ErrNoStepPath
+	}
+	return value, nil
+}
+
+// ShortestPath ignores fountains and returns the cheapest path between two points
+func (m Maze) ShortestPath(from, to *Point) ([]Point, error) {
+	value := m.searchPathAStar(*from, *to)
+	if len(value) == 0 {
+		return value, ErrNoPath
 	}
 	return value, nil
 }
@@ -380,7 +469,8 @@ func (c itemList) Len() int           { return len(c) }
 func (c itemList) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
 func (c itemList) Less(i, j int) bool { return c[i].distance < c[j].distance }
 
-func Nearest(thing []Point, location *Point, count int) []Point {
+// Nearest returns up to count things closest to location, leaving out the one at location
+func (m Maze) Nearest(thing []Point, location *Point, count int) []Point {
 
 	list := make(itemList, len(thing))
 
@@ -392,12 +482,14 @@ func Nearest(thing []Point, location *Point, count int) []Point {
 	}
 
 	sort.Sort(list)
-	fmt.Println(list)
+	m.logger().Debug("nearest", "location", *location, "count", count, "candidates", len(list))
 
-	things := make([]Point, count)
-	if list[0].location == *location {
+	if len(list) > 0 && list[0].location == *location {
 		list = list[1:]
 	}
+	count = max(0, min(count, len(list)))
+
+	things := make([]Point, count)
 
 	for c := 0; c < count; c++ {
 		things[c] = list[c].location
@@ -406,13 +498,58 @@ func Nearest(thing []Point, location *Point, count int) []Point {
 	return things
 }
 
+// Fingerprint identifies the map by its tiles, so every photo of the same map has
+// the same fingerprint however it was forwarded
+func (m Maze) Fingerprint() string {
+	h := sha256.New()
+	for _, row := range m.Pixels {
+		// the row lengths keep maps of different shapes with the same tiles apart
+		binary.Write(h, binary.BigEndian, uint32(len(row)))
+		h.Write(row)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// tileText is how each tile is written in text renderings of the map, in ASCII and
+// in the emoji squares Chat Wars uses for scribbles
+var tileText = map[uint8][2]string{
+	tWALL:     {"#", "\u2b1b"},
+	tPATH:     {".", "\u2b1c"},
+	tFAMOUS:   {"f", "\U0001f7e6"},
+	tFOUNTAIN: {"F", "\U0001f7e9"},
+	tCHEST:    {"C", "\U0001f7eb"},
+	tBONFIRE:  {"B", "\U0001f7e7"},
+	tMONSTER:  {"M", "\U0001f7ea"},
+	tBOSS:     {"X", "\U0001f7e5"},
+}
+
+// Text renders the map with a character per tile, in ASCII or as emoji
+func (m Maze) Text(emoji bool) string {
+	style := 0
+	if emoji {
+		style = 1
+	}
+
+	var b strings.Builder
+	for _, row := range m.Pixels {
+		for _, tile := range row {
+			if text, found := tileText[tile]; found {
+				b.WriteString(text[style])
+			} else {
+				b.WriteString("?")
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
 func (m Maze) ColorModel() color.Model {
 	return color.RGBAModel
 }
 
 func (m Maze) Bounds() image.Rectangle {
-	max := len(m.Pixels) * 5
-	return image.Rect(0, 0, max, max)
+	return image.Rect(0, 0, m.Pixels.Width()*5, m.Pixels.Height()*5)
 }
 
 func (m Maze) At(x, y int) color.Color {
@@ -459,6 +596,19 @@ type Scribble struct {
 	Points         [][]uint8 `json:"points"`
 	PlayerLocation Point     `json:"playerLocation"`
 	Matches        []Point   `json:"matches"`
+	// Closest is where the scribble came nearest to matching, when it matches nowhere
+	Closest []NearMatch `json:"closest,omitempty"`
+	// Unknown lists the glyphs that weren't recognized, they matched any tile
+	Unknown []string `json:"unknown,omitempty"`
+}
+
+// width is the length of the longest row
+func (s Scribble) width() int {
+	width := 0
+	for _, row := range s.Points {
+		width = max(width, len(row))
+	}
+	return width
 }
 
 func (s Scribble) ColorModel() color.Model {
@@ -466,61 +616,54 @@ func (s Scribble) ColorModel() color.Model {
 }
 
 func (s Scribble) Bounds() image.Rectangle {
-	ymax := len(s.Points) * 5
-	xmax := len(s.Points[0]) * 5
-	return image.Rect(0, 0, xmax, ymax)
+	return image.Rect(0, 0, s.width()*5, len(s.Points)*5)
 }
 
+// At draws the scribble the way it was understood, the player in yellow and
+// anything that wasn't recognized in grey
 func (s Scribble) At(x, y int) color.Color {
-	return mazeColorMap(s.Points[y/5][x/5])
+	row := s.Points[y/5]
+	switch {
+	case x/5 >= len(row) || row[x/5] == tANY:
+		return color.RGBA{128, 128, 128, 255}
+	case row[x/5] == tPLAYER:
+		return color.RGBA{255, 221, 0, 255}
+	default:
+		return mazeColorMap(row[x/5])
+	}
 }
 
 func (s Scribble) String() string {
 	return fmt.Sprintf("Found %d matches: %s", len(s.Matches), fmt.Sprint(s.Matches))
 }
 
-// parse a scribble string from chat wars
-func parseScribble(scribble string) Scribble {
+// parse a scribble string from chat wars, glyphs that aren't known match any tile
+func parseScribble(scribble string, log *slog.Logger) Scribble {
 	rows := strings.Split(scribble, "\n")
-	var playerLocation Point
-
-	scrib := make([][]uint8, len(rows))
-	for i := range rows {
-		// Remove Unicode Variation Selectors
-		realString := strings.Map(func(r rune) rune {
-			if unicode.In(r, unicode.Variation_Selector) {
-				return -1
+	s := Scribble{Points: make([][]uint8, len(rows)), Matches: make([]Point, 0)}
+
+	for y, row := range rows {
+		for _, r := range row {
+			if ignoredInScribble(r) {
+				continue
+			}
+
+			tile, found := scribbleGlyphs[r]
+			if !found {
+				tile = tANY
+				if !slices.Contains(s.Unknown, string(r)) {
+					s.Unknown = append(s.Unknown, string(r))
+				}
+				logUnknownGlyph(r, log)
 			}
-			return r
-		}, rows[i])
-		runes := []rune(realString)
-		scrib[i] = make([]uint8, len(runes))
-		fmt.Println(len(runes))
-		fmt.Println(realString)
-		for j, rune := range runes {
-			fmt.Printf("%d: \"%c\" %+q\n", j, rune, rune)
-			switch rune {
-			case '\u2b1b':
-				scrib[i][j] = tWALL
-			case '\u2b1c':
-				scrib[i][j] = tPATH
-			case '\U0001f7e8':
-				scrib[i][j] = 254 // player overwrites other types
-				playerLocation = Point{j, i}
-			case '\U0001f7e9':
-				scrib[i][j] = tFOUNTAIN
-			case '\U0001f7e7':
-				scrib[i][j] = tBONFIRE
-			case '\U0001f7e6':
-				scrib[i][j] = tFAMOUS
-			case '\U0001f7ea':
-				scrib[i][j] = tMONSTER
-			default:
-				scrib[i][j] = 255
+			if tile == tPLAYER {
+				s.PlayerLocation = Point{len(s.Points[y]), y}
 			}
+			s.Points[y] = append(s.Points[y], tile)
 		}
+		log.Debug("scribble row", "row", y, "length", len(s.Points[y]), "text", row)
 	}
-	return Scribble{scrib, playerLocation, make([]Point, 0)}
+	return s
 }
 
 // An Item is something we manage in a priority queue.
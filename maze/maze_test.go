@@ -1,11 +1,16 @@
 package cwmaze
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	_ "image/jpeg"
 	"log"
+	"log/slog"
 	"os"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -73,3 +78,177 @@ func setup() Maze {
 	return m
 
 }
+
+func TestNearest(t *testing.T) {
+	things := []Point{{5, 5}, {1, 1}, {3, 3}}
+
+	n := Maze{}.Nearest(things, &Point{0, 0}, 2)
+	if len(n) != 2 || n[0] != (Point{1, 1}) || n[1] != (Point{3, 3}) {
+		t.Fatalf("Nearest(things, {0, 0}, 2) = %v, want [{1, 1} {3, 3}]", n)
+	}
+
+	// the player's own location is skipped, and the count is limited to what exists
+	n = Maze{}.Nearest(things, &Point{1, 1}, 5)
+	if len(n) != 2 {
+		t.Fatalf("len(Nearest(things, {1, 1}, 5)) = %d, want 2", len(n))
+	}
+}
+
+func TestMazeLog(t *testing.T) {
+	var out bytes.Buffer
+	m := Maze{Log: slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})).With("chat_id", 5)}
+	m.Nearest([]Point{{1, 1}}, &Point{0, 0}, 1)
+	if !strings.Contains(out.String(), "nearest") || !strings.Contains(out.String(), "chat_id=5") {
+		t.Errorf("logged %q, want the search with the caller's fields", out.String())
+	}
+
+	// without a logger nothing is logged, and nothing breaks
+	Maze{}.Nearest([]Point{{1, 1}}, &Point{0, 0}, 1)
+}
+
+func TestFingerprint(t *testing.T) {
+	m := setup()
+	same := setup()
+	if m.Fingerprint() != same.Fingerprint() {
+		t.Fatalf("the same map has fingerprints %s and %s", m.Fingerprint(), same.Fingerprint())
+	}
+
+	same.Pixels[1][1] = tMONSTER
+	if m.Fingerprint() == same.Fingerprint() {
+		t.Errorf("changing a tile kept the fingerprint %s", m.Fingerprint())
+	}
+
+	square := Maze{Pixels: [][]uint8{{1, 1}, {1, 1}}}
+	wide := Maze{Pixels: [][]uint8{{1, 1, 1, 1}}}
+	if square.Fingerprint() == wide.Fingerprint() {
+		t.Errorf("maps of different shapes share the fingerprint %s", square.Fingerprint())
+	}
+}
+
+func TestText(t *testing.T) {
+	m := Maze{Pixels: [][]uint8{{tWALL, tPATH, tBOSS}, {tCHEST, 9, tWALL}}}
+	if got, want := m.Text(false), "#.X\nC?#\n"; got != want {
+		t.Errorf("Text(false) = %q, want %q", got, want)
+	}
+	if got, want := m.Text(true), "⬛⬜🟥\n🟫?⬛\n"; got != want {
+		t.Errorf("Text(true) = %q, want %q", got, want)
+	}
+}
+
+func TestNearMatches(t *testing.T) {
+	m := setup()
+	scribble, err := os.ReadFile("testdata/corpus/full-1.scribble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a wall drawn as a path in the corner, as if the map changed there
+	misdrawn := strings.Replace(string(scribble), "⬛", "⬜", 1)
+
+	s := m.SearchByScribble(strings.TrimSuffix(misdrawn, "\n"))
+	if len(s.Matches) != 0 {
+		t.Fatalf("misdrawn scribble matches %v", s.Matches)
+	}
+
+	near := m.NearMatches(s, 3)
+	if len(near) != 3 {
+		t.Fatalf("NearMatches returned %v, want 3 places", near)
+	}
+	if want := (NearMatch{At: Point{15, 0}, Mismatches: 1}); near[0] != want {
+		t.Errorf("closest place is %v, want %v", near[0], want)
+	}
+	for i := 1; i < len(near); i++ {
+		if near[i].Mismatches < near[i-1].Mismatches {
+			t.Errorf("NearMatches returned %v, which is not closest first", near)
+		}
+	}
+
+	if near := m.NearMatches(parseScribble("", discardLogger), 3); len(near) != 0 {
+		t.Errorf("empty scribble is near %v", near)
+	}
+}
+
+func TestParseScribbleGlyphs(t *testing.T) {
+	m := Maze{Pixels: Grid{
+		{tWALL, tPATH, tFAMOUS, tFOUNTAIN},
+		{tCHEST, tBONFIRE, tMONSTER, tBOSS},
+	}}
+	s := parseScribble(strings.TrimSuffix(m.Text(true), "\n"), discardLogger)
+	for y, row := range m.Pixels {
+		if !slices.Equal(s.Points[y], row) {
+			t.Errorf("row %d parsed as %v, want %v", y, s.Points[y], row)
+		}
+	}
+	if len(s.Unknown) != 0 {
+		t.Errorf("glyphs %v were not recognized", s.Unknown)
+	}
+
+	// the player is drawn over their tile, variation selectors and carriage returns are dropped
+	s = parseScribble("⬛️⬜️\r\n🟨⬛\n❓⬜🆕❓", discardLogger)
+	want := [][]uint8{{tWALL, tPATH}, {tPLAYER, tWALL}, {tANY, tPATH, tANY, tANY}}
+	for y := range want {
+		if !slices.Equal(s.Points[y], want[y]) {
+			t.Errorf("row %d parsed as %v, want %v", y, s.Points[y], want[y])
+		}
+	}
+	if s.PlayerLocation != (Point{0, 1}) {
+		t.Errorf("player at %s, want {0, 1}", s.PlayerLocation)
+	}
+	if !slices.Equal(s.Unknown, []string{"❓", "🆕"}) {
+		t.Errorf("unknown glyphs %q, want ❓ and 🆕 once each", s.Unknown)
+	}
+
+	// a chest only matches a chest, a fountain matches either
+	maze := Maze{Pixels: Grid{{tFOUNTAIN, tCHEST}}}
+	if got := maze.SearchByScribble("🟫").Matches; !slices.Equal(got, []Point{{1, 0}}) {
+		t.Errorf("chest matches %v, want {1, 0}", got)
+	}
+	if got := maze.SearchByScribble("🟩").Matches; len(got) != 2 {
+		t.Errorf("fountain matches %v, want both tiles", got)
+	}
+}
+
+func TestFindScribble(t *testing.T) {
+	grid := "⬛⬜⬛\n⬜🟨⬜\n⬛🟩⬛"
+	cases := []struct {
+		name, text, want string
+	}{
+		{"english", "You stopped and tried to mark your way on paper.\n\n" + grid + "\n\nSome other text", grid},
+		{"russian", "Ты остановился и попытался отметить путь на бумаге.\n\n" + grid + "\n\nКакой-то текст", grid},
+		{"pasted", "  ⬛⬜⬛ \n⬜🟨⬜\r\n⬛🟩⬛\n", grid},
+		{"spaced", "⬛ ⬜ ⬛\n⬜\t🟨 ⬜\n⬛  🟩 ⬛", grid},
+		{"command", "/locate\n" + grid, grid},
+		{"variation selectors", "⬛️⬜️⬛️\n⬜️🟨⬜️", "⬛️⬜️⬛️\n⬜️🟨⬜️"},
+		{"unknown glyph", "⬛⬜⬛❓\n⬜🟨⬜⬜", "⬛⬜⬛❓\n⬜🟨⬜⬜"},
+		{"longest grid", "⬛⬜⬛\n\n" + grid, grid},
+		{"text with a glyph", "🟩 fountains and 🟪 mobs", ""},
+		{"single row", "look 🟩🟩🟩", ""},
+		{"no grid", "/path_chest", ""},
+		{"empty", "", ""},
+	}
+	for _, c := range cases {
+		if got := FindScribble(c.text, 2); got != c.want {
+			t.Errorf("%s: FindScribble() = %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	if got := FindScribble("/locate\n⬛ ⬜ 🟨", 1); got != "⬛⬜🟨" {
+		t.Errorf("FindScribble() of a single row = %q, want it when one row is enough", got)
+	}
+}
+
+func TestFindPathUnreachable(t *testing.T) {
+	// the wall in the middle column splits the maze in two
+	m := Maze{Pixels: Grid{
+		{tPATH, tWALL, tPATH},
+		{tFOUNTAIN, tWALL, tBOSS},
+	}}
+	from, to := Point{0, 0}, Point{2, 1}
+	if path, err := m.FindPathWithSteps(&from, &to, DefaultSteps); !errors.Is(err, ErrNoPath) || len(path) != 0 {
+		t.Errorf("FindPathWithSteps = %v, %v, want ErrNoPath", path, err)
+	}
+
+	to = Point{0, 1}
+	if path, err := m.FindPathWithSteps(&from, &to, 0); !errors.Is(err, ErrNoStepPath) || len(path) != 2 {
+		t.Errorf("FindPathWithSteps = %v, %v, want the shortest path and ErrNoStepPath", path, err)
+	}
+}
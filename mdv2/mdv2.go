@@ -0,0 +1,229 @@
+// Package mdv2 builds and checks text in Telegram's MarkdownV2 format.
+//
+// Everything that produces a Text escapes its input, so a Text is always safe to
+// send with parse_mode MarkdownV2.
+package mdv2
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ParseMode is the value to send as parse_mode along with a Text
+const ParseMode = "MarkdownV2"
+
+// reserved characters must be escaped everywhere outside of code
+const reserved = "_*[]()~`>#+-=|{}.!\\"
+
+// Text is a fragment of valid MarkdownV2
+type Text string
+
+// Escape escapes s so Telegram displays it literally
+func Escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(reserved, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Plain is s displayed as is
+func Plain(s string) Text {
+	return Text(Escape(s))
+}
+
+// Bold sets t in bold
+func Bold(t Text) Text {
+	return "*" + t + "*"
+}
+
+// Code displays s in a monospace font, only ` and \ are escaped inside code
+func Code(s string) Text {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	return Text("`" + strings.ReplaceAll(s, "`", "\\`") + "`")
+}
+
+// Command formats a bot command that Telegram turns into a link, with args joined by underscores
+func Command(name string, args ...any) Text {
+	parts := []string{"/" + name}
+	for _, arg := range args {
+		parts = append(parts, fmt.Sprint(arg))
+	}
+	return Plain(strings.Join(parts, "_"))
+}
+
+// Coordinate formats a map position the way the bot displays them everywhere
+func Coordinate(x, y int) Text {
+	return Plain(fmt.Sprintf("{%d, %d}", x, y))
+}
+
+// Join concatenates the parts with sep between them, sep is escaped
+func Join(sep string, parts ...Text) Text {
+	s := make([]string, len(parts))
+	for i := range parts {
+		s[i] = string(parts[i])
+	}
+	return Text(strings.Join(s, Escape(sep)))
+}
+
+// Len is the length of t as Telegram counts it against its message and caption
+// limits: in UTF-16 code units, after removing markup and link URLs
+func Len(t Text) int {
+	runes := []rune(t)
+	n := 0
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == '\\' && i+1 < len(runes):
+			i++
+			n += utf16Len(runes[i])
+		case r == ']' && i+1 < len(runes) && runes[i+1] == '(':
+			// skip the URL, up to the first unescaped closing parenthesis
+			for i += 2; i < len(runes) && runes[i] != ')'; i++ {
+				if runes[i] == '\\' {
+					i++
+				}
+			}
+		case strings.ContainsRune("*_~|`[", r):
+		default:
+			n += utf16Len(r)
+		}
+	}
+	return n
+}
+
+// utf16Len is how many UTF-16 code units encode r
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+var (
+	ErrUnescaped   = errors.New("reserved character must be escaped")
+	ErrBadEscape   = errors.New("invalid escape sequence")
+	ErrUnclosed    = errors.New("entity is not closed")
+	ErrBadNesting  = errors.New("entities are not nested properly")
+	ErrInvalidLink = errors.New("invalid inline link")
+	ErrEmpty       = errors.New("text is empty")
+)
+
+// Validate reports whether s follows Telegram's MarkdownV2 rules:
+// reserved characters are escaped, and every entity is closed and nested properly.
+func Validate(s string) error {
+	if s == "" {
+		return ErrEmpty
+	}
+
+	runes := []rune(s)
+	var stack []string
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\':
+			if i+1 >= len(runes) || runes[i+1] < 1 || runes[i+1] > 126 {
+				return fmt.Errorf("%w at offset %d", ErrBadEscape, i)
+			}
+			i++
+		case r == '`':
+			delim := "`"
+			if strings.HasPrefix(string(runes[i:]), "```") {
+				delim = "```"
+			}
+			end, err := scanCode(runes, i+len(delim), delim)
+			if err != nil {
+				return err
+			}
+			i = end + len(delim) - 1
+		case r == '[':
+			end, err := scanLink(runes, i)
+			if err != nil {
+				return err
+			}
+			i = end
+		case r == '*' || r == '_' || r == '~' || r == '|':
+			delim := string(r)
+			if (r == '_' || r == '|') && i+1 < len(runes) && runes[i+1] == r {
+				delim += string(r)
+				i++
+			} else if r == '|' {
+				return fmt.Errorf("%w: %q at offset %d", ErrUnescaped, r, i)
+			}
+			if len(stack) > 0 && stack[len(stack)-1] == delim {
+				stack = stack[:len(stack)-1]
+			} else if contains(stack, delim) {
+				return fmt.Errorf("%w: %q at offset %d", ErrBadNesting, delim, i)
+			} else {
+				stack = append(stack, delim)
+			}
+		case strings.ContainsRune(reserved, r):
+			return fmt.Errorf("%w: %q at offset %d", ErrUnescaped, r, i)
+		}
+	}
+
+	if len(stack) > 0 {
+		return fmt.Errorf("%w: %q", ErrUnclosed, stack[len(stack)-1])
+	}
+	return nil
+}
+
+// scanCode returns the offset of the delimiter closing a code entity
+func scanCode(runes []rune, start int, delim string) (int, error) {
+	for i := start; i < len(runes); i++ {
+		switch {
+		case runes[i] == '\\':
+			if i+1 >= len(runes) || (runes[i+1] != '`' && runes[i+1] != '\\') {
+				return 0, fmt.Errorf("%w in code at offset %d", ErrBadEscape, i)
+			}
+			i++
+		case strings.HasPrefix(string(runes[i:]), delim):
+			return i, nil
+		case runes[i] == '`':
+			return 0, fmt.Errorf("%w: '`' in code at offset %d", ErrUnescaped, i)
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnclosed, delim)
+}
+
+// scanLink checks an inline link [text](url) and returns the offset of its closing parenthesis
+func scanLink(runes []rune, start int) (int, error) {
+	i := start + 1
+	for ; i < len(runes) && runes[i] != ']'; i++ {
+		if runes[i] == '\\' {
+			i++
+		}
+	}
+	if i+1 >= len(runes) || runes[i+1] != '(' {
+		return 0, fmt.Errorf("%w at offset %d", ErrInvalidLink, start)
+	}
+	if err := Validate(string(runes[start+1 : i])); err != nil {
+		return 0, err
+	}
+
+	for i += 2; i < len(runes); i++ {
+		switch runes[i] {
+		case '\\':
+			if i+1 >= len(runes) || (runes[i+1] != ')' && runes[i+1] != '\\') {
+				return 0, fmt.Errorf("%w in link at offset %d", ErrBadEscape, i)
+			}
+			i++
+		case ')':
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w at offset %d", ErrInvalidLink, start)
+}
+
+func contains(stack []string, delim string) bool {
+	for _, s := range stack {
+		if s == delim {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package mdv2
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEscape(t *testing.T) {
+	got := Escape("Boss at {1, 2}. _*[]()~`>#+-=|!\\")
+	want := "Boss at \\{1, 2\\}\\. \\_\\*\\[\\]\\(\\)\\~\\`\\>\\#\\+\\-\\=\\|\\!\\\\"
+	if got != want {
+		t.Fatalf("Escape() = %q, want %q", got, want)
+	}
+}
+
+func TestBuilders(t *testing.T) {
+	cases := []struct {
+		text Text
+		want string
+	}{
+		{Plain("Location Found!"), "Location Found\\!"},
+		{Bold(Plain("Location Found!")), "*Location Found\\!*"},
+		{Code("a`b\\c"), "`a\\`b\\\\c`"},
+		{Code("{1, 2}. _*[]"), "`{1, 2}. _*[]`"},
+		{Command("path", "mob", 1), "/path\\_mob\\_1"},
+		{Command("at", 10, 12), "/at\\_10\\_12"},
+		{Coordinate(3, 4), "\\{3, 4\\}"},
+		{Join(". ", Plain("a"), Bold(Plain("b"))), "a\\. *b*"},
+	}
+
+	for _, c := range cases {
+		if string(c.text) != c.want {
+			t.Errorf("got %q, want %q", c.text, c.want)
+		}
+		if err := Validate(string(c.text)); err != nil {
+			t.Errorf("Validate(%q) = %v", c.text, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		text string
+		err  error
+	}{
+		{"plain text", nil},
+		{"*bold _italic_ bold*", nil},
+		{"__underline__ ~strike~ ||spoiler||", nil},
+		{"`code with * and _`", nil},
+		{"```\npre `\\`` block\n```", ErrUnescaped},
+		{"```\npre \\` block\n```", nil},
+		{"[link \\!](https://t.me/\\)x)", nil},
+		{"", ErrEmpty},
+		{"Location Found!", ErrUnescaped},
+		{"{1, 2}", ErrUnescaped},
+		{"/path_mob", ErrUnclosed},
+		{"```\npre \\n block\n```", ErrBadEscape},
+		{"*bold _italic* bold_", ErrBadNesting},
+		{"`code", ErrUnclosed},
+		{"trailing \\", ErrBadEscape},
+		{"\\Ж", ErrBadEscape},
+		{"[link](https://t.me", ErrInvalidLink},
+		{"[not a link]", ErrInvalidLink},
+		{"a | b", ErrUnescaped},
+	}
+
+	for _, c := range cases {
+		err := Validate(c.text)
+		if !errors.Is(err, c.err) {
+			t.Errorf("Validate(%q) = %v, want %v", c.text, err, c.err)
+		}
+	}
+}
+
+func TestLen(t *testing.T) {
+	cases := []struct {
+		text Text
+		want int
+	}{
+		{Plain("Location Found!"), 15},
+		{Bold(Plain("a.b")) + " _c_", 5},
+		{Code("a`b"), 3},
+		{"[link \\!](https://t.me/\\)x) after", 12},
+		{"__under__ ||spoiler||", 13},
+		{Plain("Игрок 🐉"), 8},
+	}
+
+	for _, c := range cases {
+		if got := Len(c.text); got != c.want {
+			t.Errorf("Len(%q) = %d, want %d", c.text, got, c.want)
+		}
+	}
+}
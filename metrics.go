@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// a session is active if the chat sent an update within this window
+const sessionWindow = 24 * time.Hour
+
+const sessionsKey = "Sessions"
+
+var (
+	updatesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dungeonbot_updates_total",
+		Help: "Updates received on the webhook, by what happened to them.",
+	}, []string{"result"})
+
+	webhookRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dungeonbot_webhook_rejections_total",
+		Help: "Requests refused before reaching the webhook handler, by reason.",
+	}, []string{"reason"})
+
+	commandsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dungeonbot_commands_total",
+		Help: "Updates handled, by command.",
+	}, []string{"command"})
+
+	outcomesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dungeonbot_outcomes_total",
+		Help: "Results of maps, scribbles and paths, by command and outcome.",
+	}, []string{"command", "outcome"})
+
+	telegramErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dungeonbot_telegram_errors_total",
+		Help: "Failed calls to the Telegram Bot API, by method.",
+	}, []string{"method"})
+
+	mapDecodeSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dungeonbot_map_decode_seconds",
+		Help:    "Time to decode a map image and load it into a maze.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+	})
+
+	scribbleSearchSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dungeonbot_scribble_search_seconds",
+		Help:    "Time spent in SearchByScribble.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+
+	findPathSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dungeonbot_find_path_seconds",
+		Help:    "Time to find a path, by routing profile.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"routing"})
+)
+
+// since observes the seconds elapsed from start
+func since(start time.Time, observer prometheus.Observer) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// sessionsGauge reports the active sessions, it is registered once the app is set up
+func (a *App) sessionsGauge() prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dungeonbot_active_sessions",
+		Help: "Chats that sent an update within the last 24 hours.",
+	}, a.countActiveSessions)
+}
+
+// touchSession marks the chat as active
+func (a *App) touchSession(ctx context.Context, chatID int64, log *slog.Logger) {
+	now := time.Now()
+	err := a.redis.ZAdd(ctx, sessionsKey, redis.Z{Score: float64(now.Unix()), Member: chatID}).Err()
+	if err == nil {
+		// forget chats that are no longer active, so the set doesn't grow forever
+		err = a.redis.ZRemRangeByScore(ctx, sessionsKey, "-inf", strconv.FormatInt(now.Add(-sessionWindow).Unix(), 10)).Err()
+	}
+	if err != nil {
+		log.Error("could not record session", "error", err)
+	}
+}
+
+func (a *App) countActiveSessions() float64 {
+	countCtx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+
+	from := strconv.FormatInt(time.Now().Add(-sessionWindow).Unix(), 10)
+	count, err := a.redis.ZCount(countCtx, sessionsKey, from, "+inf").Result()
+	if err != nil {
+		a.log.Error("could not count active sessions", "error", err)
+		return 0
+	}
+	return float64(count)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// newErrorID returns a short random ID to tie what a user sees to the logs
+func newErrorID() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// recoverWebhook answers Telegram even if next panics. The update is marked as
+// received, since redelivering it would only panic again.
+func recoverWebhook(log *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				updatesTotal.WithLabelValues("panicked").Inc()
+				log.Error("panic in webhook handler", "error_id", newErrorID(), "panic", err, "stack", string(debug.Stack()))
+				res.WriteHeader(http.StatusOK)
+			}
+		}()
+		next.ServeHTTP(res, req)
+	})
+}
+
+// recoverUpdate is deferred by handleUpdate, it logs a panic with the update and
+// tells the chat something went wrong along with the error ID to report. The update
+// was claimed when it was received, so a redelivery is skipped.
+func (a *App) recoverUpdate(ctx context.Context, u *update, log *slog.Logger) {
+	err := recover()
+	if err == nil {
+		return
+	}
+
+	id := newErrorID()
+	updatesTotal.WithLabelValues("panicked").Inc()
+	log.Error("panic handling update", "error_id", id, "panic", err, "stack", string(debug.Stack()))
+
+	from := u.From
+	if u.CallbackQuery != nil {
+		from = u.CallbackQuery.From
+	}
+	tr := newTranslator(a.getSettings(ctx, u.chatID(), log), from, log)
+	if _, err := a.tg.SendMessage(ctx, u.chatID(), tr.T("error.internal", id)); err != nil {
+		log.Error("could not report panic", "error_id", id, "error", err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestRecoverUpdate(t *testing.T) {
+	h := newHarness(t)
+	u := &update{}
+	u.Message.Chat.ID = testChatID
+	u.From = &user{ID: testChatID, LanguageCode: "en"}
+
+	func() {
+		defer h.app.recoverUpdate(context.Background(), u, slog.Default())
+		panic("boom")
+	}()
+
+	call := h.only("sendMessage")
+	if !regexp.MustCompile(`^Something went wrong, please try again later\\\. Error ID: [0-9a-f]{8}$`).MatchString(call.Params["text"]) {
+		t.Errorf("text = %q, want an error ID", call.Params["text"])
+	}
+}
+
+func TestRecoverWebhook(t *testing.T) {
+	handler := recoverWebhook(slog.Default(), http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	}))
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/webhook", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("status %d, want 200 so Telegram doesn't redeliver", res.Code)
+	}
+}
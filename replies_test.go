@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	cwmaze "dungeonbot/maze"
+	"dungeonbot/mdv2"
+)
+
+var verb = regexp.MustCompile(`%[dsv]`)
+
+// sampleArgs fills every verb in a format with values full of reserved characters
+func sampleArgs(format string) []any {
+	var args []any
+	for _, v := range verb.FindAllString(format, -1) {
+		if v == "%d" {
+			args = append(args, -12)
+		} else {
+			args = append(args, "{1, 2}. _*[]()~`>#+-=|!\\")
+		}
+	}
+	return args
+}
+
+func TestReplyTemplatesAreValidMarkdown(t *testing.T) {
+	for lang, messages := range catalog {
+		tr := translator{lang, slog.Default()}
+		for key, format := range messages {
+			args := sampleArgs(format)
+			if text := tr.T(key, args...); mdv2.Validate(string(text)) != nil {
+				t.Errorf("%s %q: %v in %q", lang, key, mdv2.Validate(string(text)), text)
+			}
+			if text := tr.Bold(key, args...); mdv2.Validate(string(text)) != nil {
+				t.Errorf("%s %q (bold): %v in %q", lang, key, mdv2.Validate(string(text)), text)
+			}
+		}
+	}
+}
+
+func TestComposedRepliesAreValidMarkdown(t *testing.T) {
+	maze := cwmaze.Maze{Boss: cwmaze.Point{X: 3, Y: 4}, Chests: []cwmaze.Point{{X: 1, Y: 1}}}
+
+	for lang := range catalog {
+		tr := translator{lang, slog.Default()}
+		replies := map[string]mdv2.Text{
+			"location found":  tr.Bold("scribble.found") + " " + tr.T("scribble.help"),
+			"map summary":     tr.MapSummary(maze),
+			"settings":        defaultSettings().text(tr),
+			"no map":          tr.Error(errNoMap),
+			"no step path":    tr.Error(cwmaze.ErrNoStepPath),
+			"unexpected":      tr.Error(errors.New("boom! (at {1, 2})")),
+			"mob list":        tr.Markdown("list.mob", mdv2.Command("path", "mob", 1), mdv2.Coordinate(3, 4), mdv2.Command("at", 3, 4)),
+			"location set":    tr.Markdown("location.set", mdv2.Coordinate(3, 4)),
+			"scribble result": tr.T("scribble.matches", 2, "[{1 2} {3 4}]"),
+		}
+
+		for name, text := range replies {
+			if err := mdv2.Validate(string(text)); err != nil {
+				t.Errorf("%s %s: %v in %q", lang, name, err, text)
+			}
+		}
+	}
+}
+
+// testResponder replies through a scripted Bot API, returning the requests it made
+func testResponder(t *testing.T, replies string, responses ...string) (*responder, *[]*http.Request) {
+	api, _, requests := scriptedAPI(t, responses...)
+
+	settings := defaultSettings()
+	settings.Replies = replies
+	r := &responder{app: &App{tg: api, log: slog.Default()}, settings: settings, tr: translator{defaultLanguage, slog.Default()}, log: slog.Default()}
+	r.message.Chat.ID = 5
+	return r, requests
+}
+
+func methods(requests []*http.Request) []string {
+	var names []string
+	for _, req := range requests {
+		names = append(names, req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+	}
+	return names
+}
+
+func TestResponderCaptionsImage(t *testing.T) {
+	r, requests := testResponder(t, repliesAll, `200 {"ok":true,"result":{"message_id":1}}`)
+
+	r.image(image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	r.reply(r.tr.Bold("scribble.found"))
+	r.info(r.tr.T("scribble.player_at", cwmaze.Point{X: 1, Y: 2}))
+	r.flush(context.Background())
+
+	if got := methods(*requests); len(got) != 1 || got[0] != "sendPhoto" {
+		t.Fatalf("called %v, want a single sendPhoto", got)
+	}
+	want := "*Location Found\\!*\n\nPlayer at: \\{1, 2\\}"
+	if caption := (*requests)[0].FormValue("caption"); caption != want {
+		t.Errorf("caption = %q, want %q", caption, want)
+	}
+}
+
+func TestResponderSendsLongTextSeparately(t *testing.T) {
+	r, requests := testResponder(t, repliesAll,
+		`200 {"ok":true,"result":[{"message_id":1},{"message_id":2}]}`,
+		`200 {"ok":true,"result":{"message_id":3}}`,
+	)
+
+	r.image(image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	r.image(image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	r.reply(mdv2.Plain(strings.Repeat("a", maxCaptionLength)))
+	r.reply(mdv2.Plain("b"))
+	r.flush(context.Background())
+
+	if got := methods(*requests); len(got) != 2 || got[0] != "sendMediaGroup" || got[1] != "sendMessage" {
+		t.Fatalf("called %v, want sendMediaGroup then sendMessage", got)
+	}
+	if media := (*requests)[0].FormValue("media"); strings.Contains(media, "caption") {
+		t.Errorf("media group has a caption that is too long: %s", media)
+	}
+}
+
+func TestResponderTextOnly(t *testing.T) {
+	r, requests := testResponder(t, repliesText, `200 {"ok":true,"result":{"message_id":1}}`)
+
+	r.image(image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	r.reply(mdv2.Plain("one"))
+	r.info(mdv2.Plain("two"))
+	r.flush(context.Background())
+
+	if got := methods(*requests); len(got) != 1 || got[0] != "sendMessage" {
+		t.Fatalf("called %v, want a single sendMessage", got)
+	}
+}
+
+func TestBatchTexts(t *testing.T) {
+	texts := []mdv2.Text{"aaaa", "bb", "c", "dddddddd"}
+	got := batchTexts(texts, 8)
+	want := []mdv2.Text{"aaaa\n\nbb", "c", "dddddddd"}
+	if len(got) != len(want) {
+		t.Fatalf("batchTexts() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("batchTexts() = %q, want %q", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// shutdownTimeout must stay below kill_timeout in fly.toml
+	shutdownTimeout = 25 * time.Second
+	healthTimeout   = 2 * time.Second
+	maxUpdateSize   = 1 << 20
+)
+
+func (a *App) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	// everything that isn't a health check goes through authentication, so
+	// requests to unknown paths are rejected and counted there
+	mux.Handle("/", authenticateWebhook(a.config.WebhookPath, a.config.WebhookSecret, a.log, recoverWebhook(a.log, http.HandlerFunc(a.Handler))))
+	mux.HandleFunc("/healthz", a.healthz)
+	mux.HandleFunc("/readyz", a.readyz)
+	return mux
+}
+
+// newMetricsMux serves the metrics, it is only reachable on the private network
+func newMetricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// healthz reports whether the store can be reached
+func (a *App) healthz(res http.ResponseWriter, req *http.Request) {
+	pingCtx, cancel := context.WithTimeout(req.Context(), healthTimeout)
+	defer cancel()
+
+	if err := a.redis.Ping(pingCtx).Err(); err != nil {
+		a.log.Error("health check failed", "error", err)
+		http.Error(res, "redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(res, "ok")
+}
+
+// readyz reports whether the bot is accepting updates
+func (a *App) readyz(res http.ResponseWriter, req *http.Request) {
+	if !a.ready.Load() {
+		http.Error(res, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(res, "ok")
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+}
+
+// serve runs the webhook and metrics servers until SIGINT or SIGTERM, then waits
+// for in-flight requests to finish and for the queued updates to be handled
+func (a *App) serve(server, metrics *http.Server) error {
+	servers := []*http.Server{server, metrics}
+	listeners := make([]net.Listener, len(servers))
+	for i := range servers {
+		listener, err := net.Listen("tcp", servers[i].Addr)
+		if err != nil {
+			for _, l := range listeners[:i] {
+				l.Close()
+			}
+			return err
+		}
+		listeners[i] = listener
+	}
+
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		go func(server *http.Server, listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(servers[i], listeners[i])
+	}
+
+	a.ready.Store(true)
+	a.log.Info("listening", "addr", server.Addr, "metrics_addr", metrics.Addr)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	var serveErr error
+	running := len(servers)
+	select {
+	case serveErr = <-errs:
+		running--
+	case sig := <-stop:
+		a.log.Info("shutting down", "signal", sig.String())
+	}
+
+	a.ready.Store(false)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("could not finish in-flight requests: %w", err)
+		}
+	}
+	for ; running > 0; running-- {
+		if err := <-errs; serveErr == nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr = err
+		}
+	}
+
+	// the server no longer accepts updates, finish the ones already queued
+	if err := a.updates.Close(shutdownCtx); err != nil {
+		return fmt.Errorf("could not drain queued updates: %w", err)
+	}
+	return serveErr
+}
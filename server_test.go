@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMuxRouting(t *testing.T) {
+	app := newApp(Config{WebhookPath: "/webhook/abc", WebhookSecret: "s3cret"}, nil, nil, slog.Default())
+	mux := app.newMux()
+
+	cases := []struct {
+		method string
+		path   string
+		ready  bool
+		status int
+	}{
+		{http.MethodGet, "/readyz", false, http.StatusServiceUnavailable},
+		{http.MethodGet, "/readyz", true, http.StatusOK},
+		{http.MethodGet, "/", true, http.StatusNotFound},
+		{http.MethodPost, "/webhook", true, http.StatusNotFound},
+		{http.MethodPost, "/webhook/abc", true, http.StatusUnauthorized},
+		{http.MethodGet, "/metrics", true, http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		app.ready.Store(c.ready)
+		res := httptest.NewRecorder()
+		mux.ServeHTTP(res, httptest.NewRequest(c.method, c.path, nil))
+		if res.Code != c.status {
+			t.Errorf("%s %s: status %d, want %d", c.method, c.path, res.Code, c.status)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	res := httptest.NewRecorder()
+	newMetricsMux().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, name := range []string{"dungeonbot_map_decode_seconds", "dungeonbot_scribble_search_seconds"} {
+		if !strings.Contains(res.Body.String(), name) {
+			t.Errorf("/metrics does not include %s", name)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	cwmaze "dungeonbot/maze"
+	"dungeonbot/mdv2"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	routeFountains = "fountains"
+	routeShortest  = "shortest"
+
+	languageAuto = ""
+
+	repliesAll   = "all"
+	repliesImage = "image"
+	repliesText  = "text"
+
+	mapsEdit = "edit"
+	mapsPost = "post"
+
+	minStepBudget = 5
+	maxStepBudget = 100
+)
+
+// Settings are the per-chat preferences, changed with the /settings command
+type Settings struct {
+	StepBudget int    `json:"stepBudget"`
+	ListLength int    `json:"listLength"`
+	Routing    string `json:"routing"`
+	Language   string `json:"language"`
+	Replies    string `json:"replies"`
+	Maps       string `json:"maps"`
+}
+
+func defaultSettings() Settings {
+	return Settings{
+		StepBudget: cwmaze.DefaultSteps,
+		ListLength: 5,
+		Routing:    routeFountains,
+		Language:   languageAuto,
+		Replies:    repliesAll,
+		Maps:       mapsEdit,
+	}
+}
+
+type inlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+type inlineKeyboardMarkup struct {
+	InlineKeyboard [][]inlineKeyboardButton `json:"inline_keyboard"`
+}
+
+// apply changes a single setting, as encoded in the callback data of the settings keyboard
+func (s *Settings) apply(key, value string) error {
+	switch key {
+	case "steps":
+		if value == "reset" {
+			s.StepBudget = cwmaze.DefaultSteps
+			return nil
+		}
+		delta, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid step change %q", value)
+		}
+		s.StepBudget += delta
+		if s.StepBudget < minStepBudget {
+			s.StepBudget = minStepBudget
+		} else if s.StepBudget > maxStepBudget {
+			s.StepBudget = maxStepBudget
+		}
+	case "list":
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 1 || length > 10 {
+			return fmt.Errorf("invalid list length %q", value)
+		}
+		s.ListLength = length
+	case "route":
+		if value != routeFountains && value != routeShortest {
+			return fmt.Errorf("invalid routing profile %q", value)
+		}
+		s.Routing = value
+	case "lang":
+		if value == "auto" {
+			value = languageAuto
+		}
+		if value != languageAuto && value != "en" && value != "ru" {
+			return fmt.Errorf("invalid language %q", value)
+		}
+		s.Language = value
+	case "replies":
+		if value != repliesAll && value != repliesImage && value != repliesText {
+			return fmt.Errorf("invalid reply mode %q", value)
+		}
+		s.Replies = value
+	case "maps":
+		if value != mapsEdit && value != mapsPost {
+			return fmt.Errorf("invalid map mode %q", value)
+		}
+		s.Maps = value
+	case "reset":
+		*s = defaultSettings()
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+func (a *App) getSettings(ctx context.Context, chatID int64, log *slog.Logger) Settings {
+	settings := defaultSettings()
+	if err := getFromRedis(ctx, a.redis, &settings, fmt.Sprintf("%d-Settings", chatID)); err != nil {
+		if err != redis.Nil {
+			log.Error("could not fetch settings", "error", err)
+		}
+		return defaultSettings()
+	}
+	return settings
+}
+
+func (a *App) saveSettings(ctx context.Context, chatID int64, settings Settings) error {
+	settingsJson, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return a.redis.Set(ctx, fmt.Sprintf("%d-Settings", chatID), settingsJson, 0).Err()
+}
+
+// text describes the settings, escaped for MarkdownV2
+func (s Settings) text(tr translator) mdv2.Text {
+	language := s.Language
+	if language == languageAuto {
+		language = "auto"
+	}
+	return tr.Bold("settings.title") + "\n\n" + mdv2.Join("\n",
+		tr.T("settings.step_budget", s.StepBudget),
+		tr.T("settings.list_length", s.ListLength),
+		tr.T("settings.routing", tr.Plain("route."+s.Routing)),
+		tr.T("settings.language", tr.Plain("language."+language)),
+		tr.T("settings.replies", tr.Plain("replies."+s.Replies)),
+		tr.T("settings.maps", tr.Plain("maps."+s.Maps)),
+	)
+}
+
+// button marks the currently selected option with a check mark
+func button(text string, selected bool, data string) inlineKeyboardButton {
+	if selected {
+		text = "✅ " + text
+	}
+	return inlineKeyboardButton{text, "settings:" + data}
+}
+
+func (s Settings) keyboard(tr translator) inlineKeyboardMarkup {
+	return inlineKeyboardMarkup{[][]inlineKeyboardButton{
+		{
+			button("-5", false, "steps:-5"),
+			button("-1", false, "steps:-1"),
+			button(tr.Count("count.steps", s.StepBudget), false, "steps:reset"),
+			button("+1", false, "steps:+1"),
+			button("+5", false, "steps:+5"),
+		},
+		{
+			button(tr.Plain("settings.list", 3), s.ListLength == 3, "list:3"),
+			button(tr.Plain("settings.list", 5), s.ListLength == 5, "list:5"),
+			button(tr.Plain("settings.list", 10), s.ListLength == 10, "list:10"),
+		},
+		{
+			button(tr.Plain("route.fountains"), s.Routing == routeFountains, "route:"+routeFountains),
+			button(tr.Plain("route.shortest"), s.Routing == routeShortest, "route:"+routeShortest),
+		},
+		{
+			button(tr.Plain("language.auto"), s.Language == languageAuto, "lang:auto"),
+			button(tr.Plain("language.en"), s.Language == "en", "lang:en"),
+			button(tr.Plain("language.ru"), s.Language == "ru", "lang:ru"),
+		},
+		{
+			button(tr.Plain("replies.all"), s.Replies == repliesAll, "replies:"+repliesAll),
+			button(tr.Plain("replies.image"), s.Replies == repliesImage, "replies:"+repliesImage),
+			button(tr.Plain("replies.text"), s.Replies == repliesText, "replies:"+repliesText),
+		},
+		{
+			button(tr.Plain("maps.edit"), s.Maps == mapsEdit, "maps:"+mapsEdit),
+			button(tr.Plain("maps.post"), s.Maps == mapsPost, "maps:"+mapsPost),
+		},
+		{
+			button(tr.Plain("settings.reset"), false, "reset:all"),
+		},
+	}}
+}
+
+func (a *App) sendSettings(ctx context.Context, chatID int64, settings Settings, tr translator) error {
+	_, err := call[sentMessage](ctx, a.tg, chatID, "sendMessage", struct {
+		ChatID      int64                `json:"chat_id"`
+		Text        string               `json:"text"`
+		ParseMode   string               `json:"parse_mode"`
+		ReplyMarkup inlineKeyboardMarkup `json:"reply_markup"`
+	}{chatID, string(settings.text(tr)), mdv2.ParseMode, settings.keyboard(tr)})
+	return err
+}
+
+// handleSettingsCallback is called when a button on the settings keyboard is pressed
+func (a *App) handleSettingsCallback(ctx context.Context, query *callbackQuery, log *slog.Logger) {
+	defer func() {
+		_, err := call[bool](ctx, a.tg, 0, "answerCallbackQuery", struct {
+			CallbackQueryID string `json:"callback_query_id"`
+		}{query.ID})
+		if err != nil {
+			log.Error("could not answer callback query", "error", err)
+		}
+	}()
+
+	if query.Message == nil {
+		return
+	}
+
+	parts := strings.SplitN(query.Data, ":", 3)
+	if len(parts) != 3 || parts[0] != "settings" {
+		log.Warn("unknown callback data", "data", query.Data)
+		return
+	}
+
+	chatID := query.Message.Chat.ID
+	settings := a.getSettings(ctx, chatID, log)
+	if err := settings.apply(parts[1], parts[2]); err != nil {
+		log.Warn("could not apply setting", "error", err)
+		return
+	}
+
+	if err := a.saveSettings(ctx, chatID, settings); err != nil {
+		log.Error("could not save settings", "error", err)
+		return
+	}
+
+	// the language may have just changed, so pick the translator after applying
+	tr := newTranslator(settings, query.From, log)
+
+	// the result is the edited message, which we don't need
+	_, err := call[json.RawMessage](ctx, a.tg, chatID, "editMessageText", struct {
+		ChatID      int64                `json:"chat_id"`
+		MessageID   int64                `json:"message_id"`
+		Text        string               `json:"text"`
+		ParseMode   string               `json:"parse_mode"`
+		ReplyMarkup inlineKeyboardMarkup `json:"reply_markup"`
+	}{chatID, query.Message.MessageID, string(settings.text(tr)), mdv2.ParseMode, settings.keyboard(tr)})
+	// tapping the option already selected leaves the message as it was
+	if err != nil && !isNotModified(err) {
+		log.Error("could not update settings message", "error", err)
+	}
+}
+
+// findPath routes between two points using the chat's routing profile and step budget
+func findPath(maze *cwmaze.Maze, settings Settings, from, to *cwmaze.Point) ([]cwmaze.Point, error) {
+	if settings.Routing == routeShortest {
+		return maze.ShortestPath(from, to)
+	}
+	return maze.FindPathWithSteps(from, to, settings.StepBudget)
+}
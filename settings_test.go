@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	cwmaze "dungeonbot/maze"
+)
+
+func TestSettingsApply(t *testing.T) {
+	changed := func(change func(*Settings)) Settings {
+		s := defaultSettings()
+		change(&s)
+		return s
+	}
+
+	cases := []struct {
+		key, value string
+		from       Settings
+		want       Settings
+		err        bool
+	}{
+		{"steps", "+5", defaultSettings(), changed(func(s *Settings) { s.StepBudget = cwmaze.DefaultSteps + 5 }), false},
+		{"steps", "-1", defaultSettings(), changed(func(s *Settings) { s.StepBudget = cwmaze.DefaultSteps - 1 }), false},
+		{"steps", "-5", changed(func(s *Settings) { s.StepBudget = minStepBudget + 2 }), changed(func(s *Settings) { s.StepBudget = minStepBudget }), false},
+		{"steps", "+5", changed(func(s *Settings) { s.StepBudget = maxStepBudget - 1 }), changed(func(s *Settings) { s.StepBudget = maxStepBudget }), false},
+		{"steps", "reset", changed(func(s *Settings) { s.StepBudget = 60 }), defaultSettings(), false},
+		{"steps", "many", defaultSettings(), defaultSettings(), true},
+		{"list", "3", defaultSettings(), changed(func(s *Settings) { s.ListLength = 3 }), false},
+		{"list", "10", defaultSettings(), changed(func(s *Settings) { s.ListLength = 10 }), false},
+		{"list", "0", defaultSettings(), defaultSettings(), true},
+		{"list", "11", defaultSettings(), defaultSettings(), true},
+		{"list", "x", defaultSettings(), defaultSettings(), true},
+		{"route", routeShortest, defaultSettings(), changed(func(s *Settings) { s.Routing = routeShortest }), false},
+		{"route", "scenic", defaultSettings(), defaultSettings(), true},
+		{"lang", "ru", defaultSettings(), changed(func(s *Settings) { s.Language = "ru" }), false},
+		{"lang", "auto", changed(func(s *Settings) { s.Language = "ru" }), defaultSettings(), false},
+		{"lang", "de", defaultSettings(), defaultSettings(), true},
+		{"replies", repliesText, defaultSettings(), changed(func(s *Settings) { s.Replies = repliesText }), false},
+		{"replies", "loud", defaultSettings(), defaultSettings(), true},
+		{"maps", mapsPost, defaultSettings(), changed(func(s *Settings) { s.Maps = mapsPost }), false},
+		{"maps", "print", defaultSettings(), defaultSettings(), true},
+		{"reset", "all", Settings{StepBudget: 9, ListLength: 3, Routing: routeShortest, Language: "ru", Replies: repliesText, Maps: mapsPost}, defaultSettings(), false},
+		{"colour", "red", defaultSettings(), defaultSettings(), true},
+	}
+
+	for _, c := range cases {
+		s := c.from
+		err := s.apply(c.key, c.value)
+		if (err != nil) != c.err {
+			t.Errorf("apply(%q, %q) error = %v, want error %v", c.key, c.value, err, c.err)
+		}
+		if s != c.want {
+			t.Errorf("apply(%q, %q) = %+v, want %+v", c.key, c.value, s, c.want)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dungeonbot/mdv2"
+
+	"github.com/lawn-chair/gobot/tgbot"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	maxAttempts    = 4
+	initialBackoff = 500 * time.Millisecond
+	// Telegram asks for no more than one message per second in a chat,
+	// and 20 per minute in groups
+	privateChatRate = 1.0
+	groupChatRate   = 20.0 / 60
+	chatBurst       = 3
+	// buckets that have been idle this long are full again and can be forgotten
+	idleBucket = time.Minute
+
+	maxMessageLength = 4096
+	maxCaptionLength = 1024
+	maxMediaGroup    = 10
+)
+
+var telegramRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "dungeonbot_telegram_retries_total",
+	Help: "Calls to the Telegram Bot API that were retried, by method and reason.",
+}, []string{"method", "reason"})
+
+// apiError is an error response from the Bot API
+type apiError struct {
+	Method      string
+	Code        int
+	Description string
+	RetryAfter  int
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("telegram %s failed with %d: %s", e.Method, e.Code, e.Description)
+}
+
+// isNotModified reports whether an edit failed only because it would not change the message
+func isNotModified(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && strings.Contains(apiErr.Description, "message is not modified")
+}
+
+// apiResponse is the envelope of every Bot API response
+type apiResponse[T any] struct {
+	OK          bool   `json:"ok"`
+	Result      T      `json:"result"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// sentMessage is the part of a sent message we need back
+type sentMessage struct {
+	MessageID int64       `json:"message_id"`
+	Photo     []photoSize `json:"photo"`
+}
+
+// telegram is a Bot API client for a tgbot.Bot, pacing messages to each chat
+// and retrying the calls Telegram asks us to retry
+type telegram struct {
+	bot     tgbot.Bot
+	baseURL string
+	client  *http.Client
+	limiter *chatLimiter
+	// fileIDs lets us send images we uploaded before without uploading them again, it may be nil
+	fileIDs fileIDCache
+	// sleep waits for d or until ctx is done, replaced in tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// upload is a file sent along with a Bot API call
+type upload struct {
+	field string
+	name  string
+	data  []byte
+}
+
+func newTelegram(bot tgbot.Bot, baseURL string) *telegram {
+	return &telegram{
+		bot:     bot,
+		baseURL: baseURL,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		limiter: newChatLimiter(time.Now),
+		sleep:   sleep,
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do paces a call to the chat, then sends it until it succeeds, fails for good or
+// runs out of attempts. A chatID of 0 is not rate limited.
+func (t *telegram) do(ctx context.Context, chatID int64, method string, send func() (*http.Response, error)) (*http.Response, error) {
+	if chatID != 0 {
+		if err := t.sleep(ctx, t.limiter.reserve(chatID)); err != nil {
+			return nil, err
+		}
+	}
+
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		res, err := send()
+		wait, reason := backoff, "network"
+
+		if err == nil {
+			if res.StatusCode < 300 {
+				return res, nil
+			}
+			apiErr := readAPIError(method, res)
+			err = apiErr
+			switch {
+			case apiErr.Code == http.StatusTooManyRequests:
+				reason = "rate_limited"
+				if apiErr.RetryAfter > 0 {
+					wait = time.Duration(apiErr.RetryAfter) * time.Second
+				}
+			case apiErr.Code >= 500:
+				reason = "server_error"
+			default:
+				// the request itself is wrong, sending it again won't help
+				telegramErrors.WithLabelValues(method).Inc()
+				return nil, err
+			}
+		}
+
+		if attempt == maxAttempts {
+			telegramErrors.WithLabelValues(method).Inc()
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		telegramRetries.WithLabelValues(method, reason).Inc()
+		loggerFrom(ctx).Warn("retrying telegram call", "method", method, "chat_id", chatID, "attempt", attempt, "wait", wait, "error", err)
+		if err := t.sleep(ctx, wait); err != nil {
+			telegramErrors.WithLabelValues(method).Inc()
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// readAPIError turns a failed response into an apiError, closing the body
+func readAPIError(method string, res *http.Response) *apiError {
+	defer res.Body.Close()
+
+	apiErr := &apiError{Method: method, Code: res.StatusCode, Description: res.Status}
+	body := &apiResponse[json.RawMessage]{}
+	if err := json.NewDecoder(res.Body).Decode(body); err == nil && body.ErrorCode != 0 {
+		apiErr.Code = body.ErrorCode
+		apiErr.Description = body.Description
+		apiErr.RetryAfter = body.Parameters.RetryAfter
+	}
+	return apiErr
+}
+
+// decodeResult reads the result of a successful call, closing the body
+func decodeResult[T any](method string, res *http.Response) (T, error) {
+	defer res.Body.Close()
+
+	body := &apiResponse[T]{}
+	if err := json.NewDecoder(res.Body).Decode(body); err != nil {
+		return body.Result, fmt.Errorf("could not decode %s response: %w", method, err)
+	}
+	if !body.OK {
+		return body.Result, &apiError{Method: method, Code: body.ErrorCode, Description: body.Description}
+	}
+	return body.Result, nil
+}
+
+func (t *telegram) post(ctx context.Context, method, contentType string, body []byte) (*http.Response, error) {
+	url := fmt.Sprintf("%s/bot%s/%s", t.baseURL, t.bot.API_KEY, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return t.client.Do(req)
+}
+
+// call sends a Bot API method with JSON parameters and decodes its result into T
+func call[T any](ctx context.Context, t *telegram, chatID int64, method string, params any) (T, error) {
+	var zero T
+	body, err := json.Marshal(params)
+	if err != nil {
+		return zero, err
+	}
+
+	res, err := t.do(ctx, chatID, method, func() (*http.Response, error) {
+		return t.post(ctx, method, "application/json", body)
+	})
+	if err != nil {
+		return zero, err
+	}
+	return decodeResult[T](method, res)
+}
+
+// callWithFiles sends a Bot API method as a multipart form, for uploads
+func callWithFiles[T any](ctx context.Context, t *telegram, chatID int64, method string, fields map[string]string, files []upload) (T, error) {
+	var zero T
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return zero, err
+		}
+	}
+	for _, file := range files {
+		part, err := form.CreateFormFile(file.field, file.name)
+		if err != nil {
+			return zero, err
+		}
+		if _, err := part.Write(file.data); err != nil {
+			return zero, err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return zero, err
+	}
+
+	res, err := t.do(ctx, chatID, method, func() (*http.Response, error) {
+		return t.post(ctx, method, form.FormDataContentType(), body.Bytes())
+	})
+	if err != nil {
+		return zero, err
+	}
+	return decodeResult[T](method, res)
+}
+
+// SendMessage sends MarkdownV2 text to a chat
+func (t *telegram) SendMessage(ctx context.Context, chatID int64, text mdv2.Text) (sentMessage, error) {
+	return call[sentMessage](ctx, t, chatID, "sendMessage", struct {
+		ChatID    int64  `json:"chat_id"`
+		Text      string `json:"text"`
+		ParseMode string `json:"parse_mode"`
+	}{chatID, string(text), mdv2.ParseMode})
+}
+
+// SendPhoto sends an image to a chat as a PNG, with an optional caption
+func (t *telegram) SendPhoto(ctx context.Context, chatID int64, img image.Image, caption mdv2.Text) (sentMessage, error) {
+	p, err := t.preparePhoto(ctx, img)
+	if err != nil {
+		return sentMessage{}, err
+	}
+
+	fields := map[string]string{"chat_id": strconv.FormatInt(chatID, 10)}
+	if caption != "" {
+		fields["caption"] = string(caption)
+		fields["parse_mode"] = mdv2.ParseMode
+	}
+	var files []upload
+	if p.fileID != "" {
+		fields["photo"] = p.fileID
+	} else {
+		files = append(files, upload{"photo", "map.png", p.data})
+	}
+
+	sent, err := callWithFiles[sentMessage](ctx, t, chatID, "sendPhoto", fields, files)
+	if err == nil {
+		t.remember(ctx, p, sent)
+	}
+	return sent, err
+}
+
+// inputMediaPhoto is a photo in a media group or edit, media is a file_id or
+// refers to an uploaded file as attach://<field>
+type inputMediaPhoto struct {
+	Type      string `json:"type"`
+	Media     string `json:"media"`
+	Caption   string `json:"caption,omitempty"`
+	ParseMode string `json:"parse_mode,omitempty"`
+}
+
+// SendMediaGroup sends between 2 and 10 images as an album, the caption goes on the first one
+func (t *telegram) SendMediaGroup(ctx context.Context, chatID int64, imgs []image.Image, caption mdv2.Text) ([]sentMessage, error) {
+	photos := make([]photo, len(imgs))
+	media := make([]inputMediaPhoto, len(imgs))
+	var files []upload
+	for i, img := range imgs {
+		p, err := t.preparePhoto(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		photos[i] = p
+		media[i] = inputMediaPhoto{Type: "photo", Media: p.media(fmt.Sprintf("photo%d", i), &files)}
+	}
+	if caption != "" {
+		media[0].Caption = string(caption)
+		media[0].ParseMode = mdv2.ParseMode
+	}
+
+	mediaJson, err := json.Marshal(media)
+	if err != nil {
+		return nil, err
+	}
+	sent, err := callWithFiles[[]sentMessage](ctx, t, chatID, "sendMediaGroup",
+		map[string]string{"chat_id": strconv.FormatInt(chatID, 10), "media": string(mediaJson)}, files)
+	if err == nil && len(sent) == len(photos) {
+		for i := range sent {
+			t.remember(ctx, photos[i], sent[i])
+		}
+	}
+	return sent, err
+}
+
+// EditMessageMedia replaces the photo in a message the bot sent earlier, along with its caption
+func (t *telegram) EditMessageMedia(ctx context.Context, chatID, messageID int64, img image.Image, caption mdv2.Text) error {
+	p, err := t.preparePhoto(ctx, img)
+	if err != nil {
+		return err
+	}
+
+	var files []upload
+	media := inputMediaPhoto{Type: "photo", Media: p.media("photo", &files)}
+	if caption != "" {
+		media.Caption = string(caption)
+		media.ParseMode = mdv2.ParseMode
+	}
+	mediaJson, err := json.Marshal(media)
+	if err != nil {
+		return err
+	}
+
+	sent, err := callWithFiles[sentMessage](ctx, t, chatID, "editMessageMedia", map[string]string{
+		"chat_id":    strconv.FormatInt(chatID, 10),
+		"message_id": strconv.FormatInt(messageID, 10),
+		"media":      string(mediaJson),
+	}, files)
+	if err == nil {
+		t.remember(ctx, p, sent)
+	}
+	return err
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	data := new(bytes.Buffer)
+	if err := png.Encode(data, img); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// telegramFile is a file stored on Telegram's servers, ready to download
+type telegramFile struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FilePath     string `json:"file_path"`
+}
+
+// GetFile looks up where to download a file from
+func (t *telegram) GetFile(ctx context.Context, fileID string) (telegramFile, error) {
+	return call[telegramFile](ctx, t, 0, "getFile", struct {
+		FileID string `json:"file_id"`
+	}{fileID})
+}
+
+// Download fetches a file from Telegram's servers, the caller closes the body
+func (t *telegram) Download(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	url := fmt.Sprintf("%s/file/bot%s/%s", t.baseURL, t.bot.API_KEY, filePath)
+	res, err := t.do(ctx, 0, "downloadFile", func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		return t.client.Do(req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// chatLimiter is a token bucket per chat
+type chatLimiter struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	buckets map[int64]*bucket
+}
+
+func newChatLimiter(now func() time.Time) *chatLimiter {
+	return &chatLimiter{now: now, buckets: make(map[int64]*bucket)}
+}
+
+// reserve takes a token from the chat's bucket and returns how long to wait before using it
+func (l *chatLimiter) reserve(chatID int64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := privateChatRate
+	if chatID < 0 {
+		rate = groupChatRate
+	}
+
+	now := l.now()
+	b, found := l.buckets[chatID]
+	if !found {
+		l.forgetIdle(now)
+		b = &bucket{tokens: chatBurst, last: now}
+		l.buckets[chatID] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > chatBurst {
+		b.tokens = chatBurst
+	}
+	b.last = now
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+func (l *chatLimiter) forgetIdle(now time.Time) {
+	for chatID, b := range l.buckets {
+		if now.Sub(b.last) > idleBucket {
+			delete(l.buckets, chatID)
+		}
+	}
+}
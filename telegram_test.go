@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"dungeonbot/mdv2"
+
+	"github.com/lawn-chair/gobot/tgbot"
+)
+
+// scriptedAPI answers Bot API calls with the given status codes and bodies in turn
+func scriptedAPI(t *testing.T, responses ...string) (*telegram, *[]time.Duration, *[]*http.Request) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		req.ParseMultipartForm(1 << 20)
+		requests = append(requests, req)
+		if len(responses) == 0 {
+			t.Errorf("unexpected request to %s", req.URL.Path)
+			res.WriteHeader(http.StatusTeapot)
+			return
+		}
+		// responses start with their status code, like "200 {...}"
+		status, _ := strconv.Atoi(responses[0][:3])
+		body := responses[0][4:]
+		responses = responses[1:]
+		res.WriteHeader(status)
+		res.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	var waits []time.Duration
+	tg := newTelegram(tgbot.Bot{API_KEY: "abcd:1234"}, server.URL)
+	tg.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	return tg, &waits, &requests
+}
+
+func TestTelegramRetriesRateLimits(t *testing.T) {
+	tg, waits, requests := scriptedAPI(t,
+		`429 {"ok":false,"error_code":429,"description":"Too Many Requests: retry after 7","parameters":{"retry_after":7}}`,
+		`502 Bad Gateway`,
+		`200 {"ok":true,"result":{"message_id":99}}`,
+	)
+
+	msg, err := tg.SendMessage(context.Background(), 5, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MessageID != 99 {
+		t.Errorf("MessageID = %d, want 99", msg.MessageID)
+	}
+	if len(*requests) != 3 {
+		t.Errorf("sent %d requests, want 3", len(*requests))
+	}
+	if (*requests)[0].URL.Path != "/botabcd:1234/sendMessage" {
+		t.Errorf("sent request to %s", (*requests)[0].URL.Path)
+	}
+
+	// the first wait is the rate limiter, which has tokens to spare
+	want := []time.Duration{0, 7 * time.Second, 2 * initialBackoff}
+	if len(*waits) != len(want) {
+		t.Fatalf("waited %v, want %v", *waits, want)
+	}
+	for i := range want {
+		if (*waits)[i] != want[i] {
+			t.Errorf("waited %v, want %v", *waits, want)
+			break
+		}
+	}
+}
+
+func TestTelegramGivesUp(t *testing.T) {
+	tg, _, requests := scriptedAPI(t,
+		`500 {"ok":false,"error_code":500,"description":"Internal Server Error"}`,
+		`500 {"ok":false,"error_code":500,"description":"Internal Server Error"}`,
+		`500 {"ok":false,"error_code":500,"description":"Internal Server Error"}`,
+		`500 {"ok":false,"error_code":500,"description":"Internal Server Error"}`,
+	)
+
+	if _, err := tg.SendMessage(context.Background(), 5, "hello"); err == nil {
+		t.Fatal("SendMessage succeeded after only server errors")
+	}
+	if len(*requests) != maxAttempts {
+		t.Errorf("sent %d requests, want %d", len(*requests), maxAttempts)
+	}
+}
+
+func TestTelegramDoesNotRetryBadRequests(t *testing.T) {
+	tg, _, requests := scriptedAPI(t,
+		`400 {"ok":false,"error_code":400,"description":"Bad Request: can't parse entities"}`,
+	)
+
+	_, err := tg.SendMessage(context.Background(), 5, "hello")
+	if err == nil || !strings.Contains(err.Error(), "can't parse entities") {
+		t.Fatalf("SendMessage = %v, want the error description", err)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("sent %d requests, want 1", len(*requests))
+	}
+}
+
+func TestTelegramSendPhoto(t *testing.T) {
+	tg, _, requests := scriptedAPI(t, `200 {"ok":true,"result":{"message_id":3}}`)
+
+	if _, err := tg.SendPhoto(context.Background(), 5, image.NewRGBA(image.Rect(0, 0, 10, 10)), mdv2.Plain("Boss!")); err != nil {
+		t.Fatal(err)
+	}
+
+	req := (*requests)[0]
+	if req.FormValue("chat_id") != "5" {
+		t.Errorf("chat_id = %q, want 5", req.FormValue("chat_id"))
+	}
+	if _, header, err := req.FormFile("photo"); err != nil || header.Filename != "map.png" {
+		t.Errorf("photo = %v, %v", header, err)
+	}
+	if req.FormValue("caption") != "Boss\\!" || req.FormValue("parse_mode") != mdv2.ParseMode {
+		t.Errorf("caption = %q with parse mode %q", req.FormValue("caption"), req.FormValue("parse_mode"))
+	}
+}
+
+func TestTelegramSendMediaGroup(t *testing.T) {
+	tg, _, requests := scriptedAPI(t, `200 {"ok":true,"result":[{"message_id":3},{"message_id":4}]}`)
+
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	sent, err := tg.SendMediaGroup(context.Background(), 5, []image.Image{img, img}, mdv2.Plain("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 {
+		t.Errorf("sent %d messages, want 2", len(sent))
+	}
+
+	req := (*requests)[0]
+	want := `[{"type":"photo","media":"attach://photo0","caption":"two","parse_mode":"MarkdownV2"},{"type":"photo","media":"attach://photo1"}]`
+	if req.FormValue("media") != want {
+		t.Errorf("media = %s, want %s", req.FormValue("media"), want)
+	}
+	for _, field := range []string{"photo0", "photo1"} {
+		if _, _, err := req.FormFile(field); err != nil {
+			t.Errorf("%s: %v", field, err)
+		}
+	}
+}
+
+func TestChatLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := newChatLimiter(func() time.Time { return now })
+
+	for i := 0; i < chatBurst; i++ {
+		if wait := limiter.reserve(1); wait != 0 {
+			t.Fatalf("message %d waits %v within the burst", i, wait)
+		}
+	}
+	if wait := limiter.reserve(1); wait != time.Second {
+		t.Errorf("private chat waits %v after the burst, want 1s", wait)
+	}
+	if wait := limiter.reserve(2); wait != 0 {
+		t.Errorf("other chat waits %v, want 0", wait)
+	}
+
+	for i := 0; i < chatBurst; i++ {
+		limiter.reserve(-100)
+	}
+	if wait := limiter.reserve(-100); wait != 3*time.Second {
+		t.Errorf("group chat waits %v after the burst, want 3s", wait)
+	}
+
+	now = now.Add(2 * idleBucket)
+	if wait := limiter.reserve(1); wait != 0 {
+		t.Errorf("idle chat waits %v, want 0", wait)
+	}
+	limiter.reserve(3)
+	if len(limiter.buckets) > 2 {
+		t.Errorf("limiter still tracks %d chats after they went idle", len(limiter.buckets))
+	}
+}
+
+func TestTelegramEditMessageMedia(t *testing.T) {
+	tg, _, requests := scriptedAPI(t,
+		`200 {"ok":true,"result":{"message_id":7}}`,
+		`400 {"ok":false,"error_code":400,"description":"Bad Request: message is not modified: specified new message content and reply markup are exactly the same"}`,
+	)
+
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	if err := tg.EditMessageMedia(context.Background(), 5, 7, img, ""); err != nil {
+		t.Fatal(err)
+	}
+	req := (*requests)[0]
+	if req.FormValue("message_id") != "7" || req.FormValue("media") != `{"type":"photo","media":"attach://photo"}` {
+		t.Errorf("message_id = %q, media = %q", req.FormValue("message_id"), req.FormValue("media"))
+	}
+
+	if err := tg.EditMessageMedia(context.Background(), 5, 7, img, ""); !isNotModified(err) {
+		t.Errorf("EditMessageMedia = %v, want a not modified error", err)
+	}
+}
+
+// memoryFileIDs is a fileIDCache for tests
+type memoryFileIDs map[string]string
+
+func (c memoryFileIDs) Get(ctx context.Context, hash string) (string, error) {
+	return c[hash], nil
+}
+
+func (c memoryFileIDs) Set(ctx context.Context, hash, fileID string) error {
+	c[hash] = fileID
+	return nil
+}
+
+func TestTelegramReusesFileIDs(t *testing.T) {
+	tg, _, requests := scriptedAPI(t,
+		`200 {"ok":true,"result":{"message_id":1,"photo":[{"file_id":"small","width":90,"height":90},{"file_id":"full","width":600,"height":600}]}}`,
+		`200 {"ok":true,"result":{"message_id":2}}`,
+		`200 {"ok":true,"result":[{"message_id":3},{"message_id":4}]}`,
+	)
+	tg.fileIDs = memoryFileIDs{}
+
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for i := 0; i < 2; i++ {
+		if _, err := tg.SendPhoto(context.Background(), 5, img, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tg.SendMediaGroup(context.Background(), 5, []image.Image{img, image.NewRGBA(image.Rect(0, 0, 5, 5))}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := (*requests)[0].FormFile("photo"); err != nil {
+		t.Errorf("first photo was not uploaded: %v", err)
+	}
+	if photo := (*requests)[1].FormValue("photo"); photo != "full" {
+		t.Errorf("second photo sent as %q, want the cached file_id", photo)
+	}
+
+	want := `[{"type":"photo","media":"full"},{"type":"photo","media":"attach://photo1"}]`
+	if media := (*requests)[2].FormValue("media"); media != want {
+		t.Errorf("media = %s, want %s", media, want)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/lawn-chair/gobot/tgbot"
+)
+
+// update is a tgbot.Update along with the fields tgbot doesn't decode
+type update struct {
+	tgbot.Update
+	UpdateID      int64
+	From          *user       // sender of Message
+	Photo         []photoSize // sizes of Message.Photo, with their file_unique_id
+	Edited        bool        // Message is an edit of an earlier message
+	CallbackQuery *callbackQuery
+}
+
+// messageFields are the fields of a message tgbot doesn't decode
+type messageFields struct {
+	From  *user       `json:"from"`
+	Photo []photoSize `json:"photo"`
+}
+
+type user struct {
+	ID           int64  `json:"id"`
+	LanguageCode string `json:"language_code"`
+}
+
+type callbackQuery struct {
+	ID      string           `json:"id"`
+	From    *user            `json:"from"`
+	Data    string           `json:"data"`
+	Message *callbackMessage `json:"message"`
+}
+
+type callbackMessage struct {
+	MessageID int64      `json:"message_id"`
+	Chat      tgbot.Chat `json:"chat"`
+}
+
+func (u *update) UnmarshalJSON(data []byte) error {
+	var extra struct {
+		UpdateID      int64           `json:"update_id"`
+		Message       messageFields   `json:"message"`
+		EditedMessage json.RawMessage `json:"edited_message"`
+		CallbackQuery *callbackQuery  `json:"callback_query"`
+	}
+
+	if err := json.Unmarshal(data, &u.Update); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return err
+	}
+
+	// an edited message is handled like a new one, so a corrected scribble is searched again
+	if extra.EditedMessage != nil {
+		if err := json.Unmarshal(extra.EditedMessage, &u.Message); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(extra.EditedMessage, &extra.Message); err != nil {
+			return err
+		}
+		u.Edited = true
+	}
+
+	u.UpdateID = extra.UpdateID
+	u.From = extra.Message.From
+	u.Photo = extra.Message.Photo
+	u.CallbackQuery = extra.CallbackQuery
+	return nil
+}
+
+// chatID is the chat the update belongs to, for messages and button presses alike
+func (u *update) chatID() int64 {
+	if u.CallbackQuery != nil && u.CallbackQuery.Message != nil {
+		return u.CallbackQuery.Message.Chat.ID
+	}
+	return u.Message.Chat.ID
+}
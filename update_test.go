@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUpdatePhotoSizes(t *testing.T) {
+	body := `{"update_id":7,"message":{"chat":{"id":5},"photo":[
+		{"file_id":"a","file_unique_id":"ua","width":320,"height":320},
+		{"file_id":"b","file_unique_id":"ub","width":1280,"height":1280},
+		{"file_id":"c","file_unique_id":"uc","width":800,"height":800}]}}`
+
+	u := &update{}
+	if err := json.Unmarshal([]byte(body), u); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Photo) != 3 {
+		t.Fatalf("decoded %d photo sizes, want 3", len(u.Photo))
+	}
+	if full := largestPhoto(u.Photo); full.FileID != "b" || full.FileUniqueID != "ub" {
+		t.Errorf("largestPhoto() = %+v, want b", full)
+	}
+}
+
+func TestUpdateEditedMessage(t *testing.T) {
+	body := `{"update_id":8,"edited_message":{"message_id":3,"chat":{"id":5},"from":{"id":5,"language_code":"ru"},"text":"⬛⬜⬛"}}`
+
+	u := &update{}
+	if err := json.Unmarshal([]byte(body), u); err != nil {
+		t.Fatal(err)
+	}
+	if !u.Edited || u.Message.Text != "⬛⬜⬛" || u.chatID() != 5 {
+		t.Errorf("edited message decoded as %+v", u)
+	}
+	if u.From == nil || u.From.LanguageCode != "ru" {
+		t.Errorf("sender = %+v, want the editor", u.From)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// defaultWebhookSecret derives a stable secret from the bot token, so every
+// instance agrees on it without extra configuration
+func defaultWebhookSecret(apiKey string) string {
+	sum := sha256.Sum256([]byte("webhook:" + apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetWebhook registers url with Telegram, asking it to send secret with every update
+func (t *telegram) SetWebhook(ctx context.Context, url, secret string) error {
+	ok, err := call[bool](ctx, t, 0, "setWebhook", struct {
+		URL         string `json:"url"`
+		SecretToken string `json:"secret_token"`
+	}{url, secret})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("telegram did not accept the webhook")
+	}
+	return nil
+}
+
+// authenticateWebhook only lets requests through to next that were sent by Telegram
+// to the webhook path, with the secret token registered in setWebhook
+func authenticateWebhook(path, secret string, log *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		reject := func(status int, reason string) {
+			webhookRejections.WithLabelValues(reason).Inc()
+			log.Warn("rejected webhook request", "remote_addr", req.RemoteAddr, "path", req.URL.Path, "reason", reason)
+			http.Error(res, http.StatusText(status), status)
+		}
+
+		if req.URL.Path != path {
+			reject(http.StatusNotFound, "path")
+			return
+		}
+		if req.Method != http.MethodPost {
+			reject(http.StatusMethodNotAllowed, "method")
+			return
+		}
+		token := req.Header.Get(secretTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			reject(http.StatusUnauthorized, "secret")
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
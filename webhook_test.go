@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAuthenticateWebhook(t *testing.T) {
+	called := false
+	handler := authenticateWebhook("/hook", "s3cret", slog.Default(), http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+
+	cases := []struct {
+		method string
+		path   string
+		secret string
+		status int
+		reason string
+	}{
+		{http.MethodPost, "/hook", "s3cret", http.StatusOK, ""},
+		{http.MethodPost, "/hook", "", http.StatusUnauthorized, "secret"},
+		{http.MethodPost, "/hook", "wrong", http.StatusUnauthorized, "secret"},
+		{http.MethodPost, "/other", "s3cret", http.StatusNotFound, "path"},
+		{http.MethodGet, "/hook", "s3cret", http.StatusMethodNotAllowed, "method"},
+	}
+
+	for _, c := range cases {
+		called = false
+		before := rejections(c.reason)
+
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader("{}"))
+		if c.secret != "" {
+			req.Header.Set(secretTokenHeader, c.secret)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		if res.Code != c.status {
+			t.Errorf("%s %s with secret %q: status %d, want %d", c.method, c.path, c.secret, res.Code, c.status)
+		}
+		if called != (c.status == http.StatusOK) {
+			t.Errorf("%s %s with secret %q: handler called = %v", c.method, c.path, c.secret, called)
+		}
+		if c.reason != "" && rejections(c.reason) == before {
+			t.Errorf("%s %s with secret %q: rejection %q not counted", c.method, c.path, c.secret, c.reason)
+		}
+	}
+}
+
+func rejections(reason string) float64 {
+	return testutil.ToFloat64(webhookRejections.WithLabelValues(reason))
+}
+
+func TestDefaultWebhookSecret(t *testing.T) {
+	secret := defaultWebhookSecret("abcd:1234")
+	if secret != defaultWebhookSecret("abcd:1234") {
+		t.Fatal("defaultWebhookSecret is not stable")
+	}
+	if secret == defaultWebhookSecret("efgh:5678") {
+		t.Fatal("defaultWebhookSecret is the same for different keys")
+	}
+	if strings.Trim(secret, "0123456789abcdef") != "" || len(secret) > 256 {
+		t.Fatalf("defaultWebhookSecret = %q, not a valid secret_token", secret)
+	}
+}